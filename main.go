@@ -2,30 +2,14 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"fmt"
+	"log"
 	"time"
 
 	"github.com/aidanhopper/reverse-proxy/proxy-engine/engine"
 	"github.com/aidanhopper/reverse-proxy/proxyd/proxyd"
 )
 
-func BasicTLS() engine.TLSConfigHandler {
-	return engine.TLSConfigHandlerFunc(func(info *tls.ClientHelloInfo) (*tls.Config, error) {
-		cert, err := tls.LoadX509KeyPair("cert/server.crt", "cert/server.key")
-		if err != nil {
-			return nil,
-				fmt.Errorf("Failed to load x509 certifcate from the filesystem with error: %s\n", err)
-		}
-		return &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			NextProtos:   []string{"h2", "http/1.1"},
-		}, nil
-	})
-}
-
 // TODO:
-// 3. Gracefully shutdown connections when an entrypoint is removed.
 // 4. Gracefully shutdown connections when a router is changed
 // 5. Add server level filter, could check IPs as a whitelist or do rate limiting
 
@@ -34,9 +18,18 @@ func main() {
 
 	server.SetFilter(nil)
 
+	certs, err := engine.NewCertStore(engine.CertStoreConfig{
+		Dir:     "cert",
+		Default: "server",
+	})
+	if err != nil {
+		log.Fatalf("Failed to load certificates with error: %s\n", err)
+	}
+	defer certs.Close()
+
 	server.RegisterTLSConfigHandler(
 		"web-secure",
-		BasicTLS(),
+		certs,
 	)
 
 	server.RegisterEntryPoint(
@@ -158,6 +151,11 @@ func main() {
 		tcpCompiler.Compile("router 1"),
 	)
 
+	server.SetDrainPolicy("minecraft", engine.DrainPolicy{
+		Mode:    engine.DrainGrace,
+		Timeout: 5 * time.Second,
+	})
+
 	go func() {
 		time.Sleep(10 * time.Second)
 		server.DeregisterEntryPoint("minecraft")
@@ -0,0 +1,667 @@
+package engine
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+type ACMEChallenge string
+
+const (
+	ACMEChallengeHTTP01    ACMEChallenge = "http-01"
+	ACMEChallengeTLSALPN01 ACMEChallenge = "tls-alpn-01"
+)
+
+const (
+	DefaultACMERenewBefore = 30 * 24 * time.Hour
+
+	acmeRenewInterval = 12 * time.Hour
+	acmeRetryInterval = time.Minute
+	acmeStartDelay    = 5 * time.Second
+	acmeObtainTimeout = 5 * time.Minute
+	acmeFallbackLife  = 365 * 24 * time.Hour
+
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	acmeAccountKey    = "account.key"
+)
+
+type ACMEConfig struct {
+	// Defaults to Let's Encrypt
+	DirectoryURL string
+	Email        string
+	Domains      []string
+	// Account key and certificates are kept here across restarts
+	StorageDir string
+	// In order of preference, defaults to every supported challenge
+	Challenges []ACMEChallenge
+	// How long before expiry a certificate is renewed
+	RenewBefore time.Duration
+	// Client used to talk to the ACME server, set it to trust a test CA
+	HTTPClient *http.Client
+	// Served for a domain until its first certificate is obtained,
+	// defaults to a self-signed certificate for every domain
+	Fallback *tls.Certificate
+}
+
+// ACMEResolver obtains and renews certificates for a fixed set of domains
+// from an ACME server. HTTP-01 challenges are answered by the middleware
+// returned from HTTPChallenge, TLS-ALPN-01 challenges by the resolver
+// itself during the handshake. Handshakes never wait on an order, domains
+// without a certificate get the fallback while one is obtained in the
+// background.
+type ACMEResolver struct {
+	config ACMEConfig
+	client *acme.Client
+
+	mu         sync.Mutex
+	certs      map[string]*tls.Certificate
+	tokens     map[string]string
+	alpnCerts  map[string]*tls.Certificate
+	obtaining  map[string]*acmeObtain
+	fallback   *tls.Certificate
+	registered bool
+	closed     bool
+	// When the last order for a domain failed, handshakes do not start
+	// another one for acmeRetryInterval
+	failed map[string]time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type acmeObtain struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func NewACMEResolver(config ACMEConfig) (*ACMEResolver, error) {
+	if len(config.Domains) == 0 {
+		return nil, fmt.Errorf("ACME resolver needs at least one domain")
+	}
+
+	if config.StorageDir == "" {
+		return nil, fmt.Errorf("ACME resolver needs a storage directory")
+	}
+
+	for _, challenge := range config.Challenges {
+		if challenge != ACMEChallengeHTTP01 && challenge != ACMEChallengeTLSALPN01 {
+			return nil, fmt.Errorf("Unsupported ACME challenge \"%s\"", challenge)
+		}
+	}
+
+	if len(config.Challenges) == 0 {
+		config.Challenges = []ACMEChallenge{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01}
+	}
+
+	if config.DirectoryURL == "" {
+		config.DirectoryURL = acme.LetsEncryptURL
+	}
+
+	if config.RenewBefore == 0 {
+		config.RenewBefore = DefaultACMERenewBefore
+	}
+
+	domains := make([]string, len(config.Domains))
+	for i, domain := range config.Domains {
+		domains[i] = strings.ToLower(domain)
+	}
+	config.Domains = domains
+
+	err := os.MkdirAll(config.StorageDir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := loadOrCreateACMEKey(filepath.Join(config.StorageDir, acmeAccountKey))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load ACME account key: %w", err)
+	}
+
+	fallback := config.Fallback
+	if fallback == nil {
+		fallback, err = selfSignedCertificate(config.Domains)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create ACME fallback certificate: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := &ACMEResolver{
+		config: config,
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: config.DirectoryURL,
+			HTTPClient:   config.HTTPClient,
+		},
+		certs:     make(map[string]*tls.Certificate),
+		tokens:    make(map[string]string),
+		alpnCerts: make(map[string]*tls.Certificate),
+		obtaining: make(map[string]*acmeObtain),
+		failed:    make(map[string]time.Time),
+		fallback:  fallback,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	for _, domain := range config.Domains {
+		cert, err := tls.LoadX509KeyPair(r.certPath(domain, ".crt"), r.certPath(domain, ".key"))
+		if err != nil {
+			continue
+		}
+		r.certs[domain] = &cert
+	}
+
+	r.wg.Add(1)
+	go r.renewLoop()
+
+	return r, nil
+}
+
+func (r *ACMEResolver) HandleTLSConfig(info *tls.ClientHelloInfo) (*tls.Config, error) {
+	domain := strings.ToLower(info.ServerName)
+
+	// TLS-ALPN-01 validation connections only want the challenge cert
+	if slices.Contains(info.SupportedProtos, acme.ALPNProto) {
+		r.mu.Lock()
+		cert, ok := r.alpnCerts[domain]
+		r.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("No pending TLS-ALPN-01 challenge for \"%s\"", domain)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+			NextProtos:   []string{acme.ALPNProto},
+		}, nil
+	}
+
+	if !r.MatchesServerName(domain) {
+		return nil, fmt.Errorf("Domain \"%s\" is not managed by this ACME resolver", domain)
+	}
+
+	r.mu.Lock()
+	cert, ok := r.certs[domain]
+	r.mu.Unlock()
+
+	if !ok || !time.Now().Before(cert.Leaf.NotAfter) {
+		r.obtainInBackground(domain)
+		cert = r.fallback
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, nil
+}
+
+func (r *ACMEResolver) MatchesServerName(serverName string) bool {
+	return slices.Contains(r.config.Domains, strings.ToLower(serverName))
+}
+
+// Certificate returns the certificate for a domain, obtaining it first if
+// there is no usable one yet. Unlike the handshake it waits on the order.
+func (r *ACMEResolver) Certificate(domain string) (*tls.Certificate, error) {
+	r.mu.Lock()
+	cert, ok := r.certs[domain]
+	r.mu.Unlock()
+
+	if ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	return r.obtain(domain)
+}
+
+// HTTPChallenge answers HTTP-01 challenges and passes every other request
+// through. It has to be on the HTTP entrypoints the ACME server validates
+// against.
+func (r *ACMEResolver) HTTPChallenge() Middleware {
+	return MiddlewareFunc(func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+		token, ok := strings.CutPrefix(req.URL.Path, acmeChallengePath)
+		if ok {
+			r.mu.Lock()
+			response, found := r.tokens[token]
+			r.mu.Unlock()
+
+			if found {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(response))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Close stops background renewals and waits for running orders to end.
+func (r *ACMEResolver) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+func (r *ACMEResolver) renewLoop() {
+	defer r.wg.Done()
+
+	// Give the entrypoints serving challenges a moment to come up
+	wait := acmeStartDelay
+	retry := acmeRetryInterval
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if r.renewDue() {
+			wait = acmeRenewInterval
+			retry = acmeRetryInterval
+			continue
+		}
+
+		wait = retry
+		retry = min(retry*2, acmeRenewInterval)
+	}
+}
+
+// renewDue obtains every missing or expiring certificate and reports
+// whether all of them succeeded.
+func (r *ACMEResolver) renewDue() bool {
+	ok := true
+
+	for _, domain := range r.config.Domains {
+		r.mu.Lock()
+		cert, present := r.certs[domain]
+		r.mu.Unlock()
+
+		if present && time.Until(cert.Leaf.NotAfter) > r.config.RenewBefore {
+			continue
+		}
+
+		_, err := r.obtain(domain)
+		if err != nil {
+			if r.ctx.Err() == nil {
+				log.Printf("%s | ACME failed to obtain certificate with error: %s\n", domain, err)
+			}
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// obtainInBackground starts an order for a domain unless one is running,
+// one failed within acmeRetryInterval or the resolver is closed.
+func (r *ACMEResolver) obtainInBackground(domain string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || r.obtaining[domain] != nil || time.Since(r.failed[domain]) < acmeRetryInterval {
+		return
+	}
+
+	// Added under mu so Close cannot be waiting already
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		_, err := r.obtain(domain)
+		if err != nil && r.ctx.Err() == nil {
+			log.Printf("%s | ACME failed to obtain certificate with error: %s\n", domain, err)
+		}
+	}()
+}
+
+// obtain orders a certificate for a domain. Concurrent calls for the same
+// domain share a single order.
+func (r *ACMEResolver) obtain(domain string) (*tls.Certificate, error) {
+	r.mu.Lock()
+	if o, ok := r.obtaining[domain]; ok {
+		r.mu.Unlock()
+		<-o.done
+		return o.cert, o.err
+	}
+
+	o := &acmeObtain{done: make(chan struct{})}
+	r.obtaining[domain] = o
+	r.mu.Unlock()
+
+	o.cert, o.err = r.order(domain)
+
+	r.mu.Lock()
+	if o.err == nil {
+		r.certs[domain] = o.cert
+		delete(r.failed, domain)
+	} else {
+		r.failed[domain] = time.Now()
+	}
+	delete(r.obtaining, domain)
+	r.mu.Unlock()
+
+	close(o.done)
+
+	if o.err == nil {
+		log.Printf("%s | ACME certificate obtained, valid until %s\n", domain, o.cert.Leaf.NotAfter)
+	}
+
+	return o.cert, o.err
+}
+
+func (r *ACMEResolver) order(domain string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, acmeObtainTimeout)
+	defer cancel()
+
+	err := r.register(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to register ACME account: %w", err)
+	}
+
+	order, err := r.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, url := range order.AuthzURLs {
+		err = r.authorize(ctx, url, domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Polled orders do not carry their own URL, hold on to it
+	orderURL := order.URI
+
+	order, err = r.client.WaitOrder(ctx, orderURL)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	der, _, err := r.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		// Servers that finalize asynchronously may not say where the order
+		// went, poll the one we already know about instead
+		finalized, waitErr := r.client.WaitOrder(ctx, orderURL)
+		if waitErr != nil || finalized.CertURL == "" {
+			return nil, err
+		}
+
+		der, err = r.client.FetchCert(ctx, finalized.CertURL, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r.storeCertificate(domain, der, key)
+}
+
+func (r *ACMEResolver) register(ctx context.Context) error {
+	r.mu.Lock()
+	registered := r.registered
+	r.mu.Unlock()
+
+	if registered {
+		return nil
+	}
+
+	account := &acme.Account{}
+	if r.config.Email != "" {
+		account.Contact = []string{"mailto:" + r.config.Email}
+	}
+
+	_, err := r.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+
+	r.mu.Lock()
+	r.registered = true
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *ACMEResolver) authorize(ctx context.Context, url string, domain string) error {
+	authz, err := r.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, preferred := range r.config.Challenges {
+		for _, offered := range authz.Challenges {
+			if offered.Type == string(preferred) {
+				challenge = offered
+				break
+			}
+		}
+		if challenge != nil {
+			break
+		}
+	}
+
+	if challenge == nil {
+		return fmt.Errorf("ACME server offered no supported challenge for \"%s\"", domain)
+	}
+
+	cleanup, err := r.prepareChallenge(challenge, domain)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	_, err = r.client.Accept(ctx, challenge)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+func (r *ACMEResolver) prepareChallenge(challenge *acme.Challenge, domain string) (func(), error) {
+	switch ACMEChallenge(challenge.Type) {
+	case ACMEChallengeHTTP01:
+		response, err := r.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		r.mu.Lock()
+		r.tokens[challenge.Token] = response
+		r.mu.Unlock()
+
+		return func() {
+			r.mu.Lock()
+			delete(r.tokens, challenge.Token)
+			r.mu.Unlock()
+		}, nil
+	case ACMEChallengeTLSALPN01:
+		cert, err := r.client.TLSALPN01ChallengeCert(challenge.Token, domain)
+		if err != nil {
+			return nil, err
+		}
+
+		r.mu.Lock()
+		r.alpnCerts[domain] = &cert
+		r.mu.Unlock()
+
+		return func() {
+			r.mu.Lock()
+			delete(r.alpnCerts, domain)
+			r.mu.Unlock()
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported ACME challenge \"%s\"", challenge.Type)
+}
+
+func (r *ACMEResolver) certPath(domain string, ext string) string {
+	return filepath.Join(r.config.StorageDir, domain+ext)
+}
+
+func (r *ACMEResolver) storeCertificate(domain string, der [][]byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	var certPEM []byte
+	for _, block := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block})...)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFileAtomic(r.certPath(domain, ".key"), keyPEM, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFileAtomic(r.certPath(domain, ".crt"), certPEM, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// selfSignedCertificate is served to clients while the real certificate
+// is obtained, they will not trust it but the handshake still completes.
+func selfSignedCertificate(domains []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(acmeFallbackLife),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func loadOrCreateACMEKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s does not contain a PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// writeFileAtomic replaces a file without readers ever seeing it half
+// written.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
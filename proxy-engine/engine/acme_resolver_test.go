@@ -0,0 +1,566 @@
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              []string{cn},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func tlsCertificate(cert *x509.Certificate, key *ecdsa.PrivateKey) tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+var acmeIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// acmeTestServer is a minimal in-process ACME server in the spirit of
+// Pebble. It trusts the JWS it is sent without checking signatures, but
+// validates HTTP-01 and TLS-ALPN-01 challenges against the addresses it
+// is given the way a real CA would.
+type acmeTestServer struct {
+	*httptest.Server
+
+	// Where challenges are validated, the proxy's HTTP and TLS entrypoints
+	HTTPAddr string
+	TLSAddr  string
+	// Lifetime of issued certificates
+	Validity time.Duration
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	mu         sync.Mutex
+	next       int
+	thumbprint string
+	authzs     map[string]*acmeTestAuthz
+	orders     map[string]*acmeTestOrder
+	certs      map[string][]byte
+	validated  map[string]int
+	issued     int
+}
+
+type acmeTestAuthz struct {
+	domain string
+	token  string
+	status string
+}
+
+type acmeTestOrder struct {
+	domain string
+	authz  string
+	status string
+	cert   string
+}
+
+func newACMETestServer(t *testing.T) *acmeTestServer {
+	t.Helper()
+
+	caCert, caKey := newTestCert(t, "acme test ca", nil, nil, true)
+
+	s := &acmeTestServer{
+		Validity:  time.Hour,
+		caCert:    caCert,
+		caKey:     caKey,
+		authzs:    make(map[string]*acmeTestAuthz),
+		orders:    make(map[string]*acmeTestOrder),
+		certs:     make(map[string][]byte),
+		validated: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *acmeTestServer) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+
+	if r.URL.Path == "/dir" {
+		s.writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+			"revokeCert": s.URL + "/revoke",
+			"keyChange":  s.URL + "/key",
+		})
+		return
+	}
+
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	protected, payload, err := decodeTestJWS(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kind, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	switch kind {
+	case "account":
+		var header struct {
+			JWK struct{ X, Y string }
+		}
+		json.Unmarshal(protected, &header)
+
+		thumbprint, err := testJWKThumbprint(header.JWK.X, header.JWK.Y)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.thumbprint = thumbprint
+
+		w.Header().Set("Location", s.URL+"/account/1")
+		s.writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case "order":
+		if id != "" {
+			s.writeOrder(w, http.StatusOK, id)
+			return
+		}
+
+		var request struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &request)
+
+		s.next++
+		domain := request.Identifiers[0].Value
+		authz := fmt.Sprint(s.next)
+		s.authzs[authz] = &acmeTestAuthz{
+			domain: domain,
+			token:  fmt.Sprintf("token-%d", s.next),
+			status: acme.StatusPending,
+		}
+		s.orders[authz] = &acmeTestOrder{domain: domain, authz: authz, status: acme.StatusPending}
+
+		s.writeOrder(w, http.StatusCreated, authz)
+	case "authz":
+		s.writeAuthz(w, id)
+	case "challenge":
+		authzID, challengeType, _ := strings.Cut(id, "/")
+		authz := s.authzs[authzID]
+
+		if err := s.validate(authz, challengeType); err != nil {
+			authz.status = acme.StatusInvalid
+		} else {
+			authz.status = acme.StatusValid
+			s.orders[authzID].status = acme.StatusReady
+			s.validated[challengeType]++
+		}
+
+		s.writeJSON(w, http.StatusOK, map[string]string{
+			"url":    s.URL + "/challenge/" + id,
+			"type":   challengeType,
+			"token":  authz.token,
+			"status": authz.status,
+		})
+	case "finalize":
+		order := s.orders[id]
+		if order.status != acme.StatusReady {
+			http.Error(w, "order is not ready", http.StatusForbidden)
+			return
+		}
+
+		var request struct{ CSR string }
+		json.Unmarshal(payload, &request)
+
+		chain, err := s.issue(request.CSR)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.certs[id] = chain
+		order.status = acme.StatusValid
+		order.cert = s.URL + "/cert/" + id
+
+		s.writeOrder(w, http.StatusOK, id)
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(s.certs[id])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *acmeTestServer) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeTestServer) writeOrder(w http.ResponseWriter, status int, id string) {
+	order := s.orders[id]
+	w.Header().Set("Location", s.URL+"/order/"+id)
+	s.writeJSON(w, status, map[string]any{
+		"status":         order.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": order.domain}},
+		"authorizations": []string{s.URL + "/authz/" + id},
+		"finalize":       s.URL + "/finalize/" + id,
+		"certificate":    order.cert,
+	})
+}
+
+func (s *acmeTestServer) writeAuthz(w http.ResponseWriter, id string) {
+	authz := s.authzs[id]
+
+	var challenges []map[string]string
+	for _, challengeType := range []ACMEChallenge{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01} {
+		challenges = append(challenges, map[string]string{
+			"url":    s.URL + "/challenge/" + id + "/" + string(challengeType),
+			"type":   string(challengeType),
+			"token":  authz.token,
+			"status": authz.status,
+		})
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"identifier": map[string]string{"type": "dns", "value": authz.domain},
+		"status":     authz.status,
+		"challenges": challenges,
+	})
+}
+
+func (s *acmeTestServer) validate(authz *acmeTestAuthz, challengeType string) error {
+	keyAuth := authz.token + "." + s.thumbprint
+
+	switch ACMEChallenge(challengeType) {
+	case ACMEChallengeHTTP01:
+		req, err := http.NewRequest(http.MethodGet, "http://"+s.HTTPAddr+acmeChallengePath+authz.token, nil)
+		if err != nil {
+			return err
+		}
+		req.Host = authz.domain
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		if string(body) != keyAuth {
+			return fmt.Errorf("http-01 response %q, want %q", body, keyAuth)
+		}
+		return nil
+	case ACMEChallengeTLSALPN01:
+		conn, err := tls.Dial("tcp", s.TLSAddr, &tls.Config{
+			ServerName:         authz.domain,
+			NextProtos:         []string{acme.ALPNProto},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		sum := sha256.Sum256([]byte(keyAuth))
+		want, _ := asn1.Marshal(sum[:])
+
+		for _, ext := range conn.ConnectionState().PeerCertificates[0].Extensions {
+			if ext.Id.Equal(acmeIdentifierOID) && string(ext.Value) == string(want) {
+				return nil
+			}
+		}
+		return fmt.Errorf("tls-alpn-01 certificate does not carry the key authorization")
+	}
+
+	return fmt.Errorf("unknown challenge %s", challengeType)
+}
+
+func (s *acmeTestServer) issue(encodedCSR string) ([]byte, error) {
+	der, err := base64.RawURLEncoding.DecodeString(encodedCSR)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+
+	s.issued++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(s.issued)),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(s.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	leaf, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...,
+	), nil
+}
+
+func (s *acmeTestServer) Validated(challenge ACMEChallenge) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.validated[string(challenge)]
+}
+
+func decodeTestJWS(body io.Reader) (protected []byte, payload []byte, err error) {
+	var jws struct{ Protected, Payload string }
+	if err := json.NewDecoder(body).Decode(&jws); err != nil {
+		return nil, nil, err
+	}
+
+	protected, err = base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return protected, payload, nil
+}
+
+func testJWKThumbprint(x string, y string) (string, error) {
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return "", err
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return "", err
+	}
+
+	return acme.JWKThumbprint(&ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	})
+}
+
+// serveACMEChallenges starts the HTTP and TLS listeners the test server
+// validates challenges against, both backed by the resolver.
+func serveACMEChallenges(t *testing.T, server *acmeTestServer, resolver *ACMEResolver) {
+	t.Helper()
+
+	httpServer := httptest.NewServer(resolver.HTTPChallenge().Wrap(http.NotFoundHandler()))
+	t.Cleanup(httpServer.Close)
+	server.HTTPAddr = httpServer.Listener.Addr().String()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server.TLSAddr = listener.Addr().String()
+
+	tlsListener := tls.NewListener(listener, &tls.Config{GetConfigForClient: resolver.HandleTLSConfig})
+	go func() {
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+}
+
+// waitForACMECertificate waits for handshakes to stop getting the
+// fallback and returns the certificate they get instead.
+func waitForACMECertificate(t *testing.T, resolver *ACMEResolver, hello *tls.ClientHelloInfo) *x509.Certificate {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		config, err := resolver.HandleTLSConfig(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf := config.Certificates[0].Leaf; leaf != resolver.fallback.Leaf {
+			return leaf
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("certificate was not obtained in the background")
+	return nil
+}
+
+func TestACMEResolver(t *testing.T) {
+	for _, challenge := range []ACMEChallenge{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01} {
+		t.Run(string(challenge), func(t *testing.T) {
+			server := newACMETestServer(t)
+
+			resolver, err := NewACMEResolver(ACMEConfig{
+				DirectoryURL: server.URL + "/dir",
+				Domains:      []string{"example.test"},
+				StorageDir:   t.TempDir(),
+				Challenges:   []ACMEChallenge{challenge},
+				RenewBefore:  time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resolver.Close()
+
+			serveACMEChallenges(t, server, resolver)
+
+			// Handshakes get the fallback without waiting, and the ones
+			// arriving while the certificate is obtained share one order
+			hello := &tls.ClientHelloInfo{ServerName: "example.test"}
+			config, err := resolver.HandleTLSConfig(hello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Certificates[0].Leaf != resolver.fallback.Leaf {
+				t.Error("first handshake was not served the fallback")
+			}
+			for range 5 {
+				resolver.HandleTLSConfig(hello)
+			}
+
+			first := waitForACMECertificate(t, resolver, hello)
+			if first.Subject.CommonName != "example.test" {
+				t.Errorf("certificate issued for %q", first.Subject.CommonName)
+			}
+			if n := server.Validated(challenge); n != 1 {
+				t.Errorf("%s validated %d times, want 1", challenge, n)
+			}
+
+			// Issued certificates live an hour, so with RenewBefore an hour
+			// they are always due
+			if !resolver.renewDue() {
+				t.Fatal("renewal failed")
+			}
+			renewed, err := resolver.Certificate("example.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if renewed.Leaf.SerialNumber.Cmp(first.SerialNumber) == 0 {
+				t.Error("certificate was not renewed")
+			}
+			if n := server.Validated(challenge); n != 2 {
+				t.Errorf("%s validated %d times after renewal, want 2", challenge, n)
+			}
+
+			// Certificates outside the renewal window are left alone
+			resolver.config.RenewBefore = time.Minute
+			if !resolver.renewDue() {
+				t.Fatal("renewal check failed")
+			}
+			current, _ := resolver.Certificate("example.test")
+			if current.Leaf.SerialNumber.Cmp(renewed.Leaf.SerialNumber) != 0 {
+				t.Error("certificate renewed before it was due")
+			}
+		})
+	}
+}
+
+func TestACMEResolverLoadsStoredCertificates(t *testing.T) {
+	server := newACMETestServer(t)
+	storage := t.TempDir()
+
+	config := ACMEConfig{
+		DirectoryURL: server.URL + "/dir",
+		Domains:      []string{"example.test"},
+		StorageDir:   storage,
+		Challenges:   []ACMEChallenge{ACMEChallengeHTTP01},
+	}
+
+	resolver, err := NewACMEResolver(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveACMEChallenges(t, server, resolver)
+
+	first, err := resolver.Certificate("example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.Close()
+
+	resolver, err = NewACMEResolver(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+
+	loaded, err := resolver.Certificate("example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Leaf.Equal(first.Leaf) {
+		t.Error("stored certificate was not reused")
+	}
+	if n := server.Validated(ACMEChallengeHTTP01); n != 1 {
+		t.Errorf("http-01 validated %d times, want 1", n)
+	}
+}
@@ -0,0 +1,358 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type BalancerMethod string
+
+const (
+	// Pick a backend at random in proportion to its weight
+	BalanceRandom BalancerMethod = "random"
+	// Take turns through the backends ignoring their weights
+	BalanceRoundRobin BalancerMethod = "round-robin"
+	// Take turns in proportion to weight, spreading each backend's turns
+	// out rather than sending them in a burst
+	BalanceWeightedRoundRobin BalancerMethod = "weighted-round-robin"
+	// Pick the backend with the fewest active requests per unit of weight
+	BalanceLeastConnections BalancerMethod = "least-connections"
+	// Pick the better of two random backends by latency and load
+	BalancePowerOfTwoEWMA BalancerMethod = "p2c-ewma"
+)
+
+// How quickly old samples stop counting towards a backend's latency
+const balancerLatencyDecay = 10 * time.Second
+
+// Balancer chooses the backend for each request sent to a pool. backends
+// is never empty. Balancers keep state between picks, so each pool needs
+// its own.
+type Balancer interface {
+	Pick(backends []*Backend) *Backend
+}
+
+// NewBalancer returns a new balancer for method, "" meaning random.
+func NewBalancer(method BalancerMethod) (Balancer, error) {
+	switch method {
+	case "", BalanceRandom:
+		return RandomBalancer(), nil
+	case BalanceRoundRobin:
+		return RoundRobinBalancer(), nil
+	case BalanceWeightedRoundRobin:
+		return WeightedRoundRobinBalancer(), nil
+	case BalanceLeastConnections:
+		return LeastConnectionsBalancer(), nil
+	case BalancePowerOfTwoEWMA:
+		return PowerOfTwoEWMABalancer(), nil
+	}
+	return nil, fmt.Errorf("Unknown balancer method \"%s\"", method)
+}
+
+// Backend is what a pool tracks about one of its members.
+type Backend struct {
+	name   string
+	weight int
+	index  int
+	health *HealthChecker
+	active atomic.Int64
+	// Unix nanoseconds, set by outlier detection
+	ejectedUntil atomic.Int64
+
+	latencyMu sync.Mutex
+	latency   float64
+	sampled   time.Time
+
+	// Smooth weighted round robin state, guarded by the balancer
+	current int
+}
+
+func (b *Backend) Name() string { return b.name }
+
+func (b *Backend) Weight() int { return b.weight }
+
+// Healthy is false while the health check fails or outlier detection has
+// ejected the backend.
+func (b *Backend) Healthy() bool {
+	if b.health != nil && !b.health.Healthy() {
+		return false
+	}
+	return !b.Ejected()
+}
+
+func (b *Backend) Ejected() bool {
+	return time.Now().Before(b.ejectedUntilTime())
+}
+
+func (b *Backend) ejectedUntilTime() time.Time {
+	return time.Unix(0, b.ejectedUntil.Load())
+}
+
+// Active is the number of requests the backend is serving.
+func (b *Backend) Active() int64 { return b.active.Load() }
+
+// Latency is the moving average of the time the backend took to serve
+// requests. It decays towards zero while the backend goes unused, so one
+// that was once slow gets tried again.
+func (b *Backend) Latency() time.Duration {
+	b.latencyMu.Lock()
+	defer b.latencyMu.Unlock()
+
+	if b.sampled.IsZero() {
+		return 0
+	}
+	return time.Duration(b.latency * latencyDecay(time.Since(b.sampled)))
+}
+
+// start counts a request against the backend and returns the function
+// that ends it.
+func (b *Backend) start() func() {
+	b.active.Add(1)
+	started := time.Now()
+
+	return func() {
+		b.active.Add(-1)
+		b.observe(started, time.Since(started))
+	}
+}
+
+// observe folds a sample into the latency. Samples are weighted by how
+// long it has been since the last one, so a backend that was idle for a
+// while is judged on how it does now.
+func (b *Backend) observe(at time.Time, sample time.Duration) {
+	b.latencyMu.Lock()
+	defer b.latencyMu.Unlock()
+
+	if b.sampled.IsZero() {
+		b.latency = float64(sample)
+		b.sampled = at
+		return
+	}
+
+	decay := latencyDecay(at.Sub(b.sampled))
+	b.latency = b.latency*decay + float64(sample)*(1-decay)
+	b.sampled = at
+}
+
+func latencyDecay(elapsed time.Duration) float64 {
+	return math.Exp(-float64(max(elapsed, 0)) / float64(balancerLatencyDecay))
+}
+
+type randomBalancer struct{}
+
+func RandomBalancer() Balancer { return randomBalancer{} }
+
+func (randomBalancer) Pick(backends []*Backend) *Backend {
+	total := 0
+	for _, b := range backends {
+		total += b.weight
+	}
+
+	n := rand.IntN(total)
+	for _, b := range backends {
+		n -= b.weight
+		if n < 0 {
+			return b
+		}
+	}
+	return backends[len(backends)-1]
+}
+
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func RoundRobinBalancer() Balancer { return &roundRobinBalancer{} }
+
+func (r *roundRobinBalancer) Pick(backends []*Backend) *Backend {
+	n := r.next.Add(1) - 1
+	return backends[n%uint64(len(backends))]
+}
+
+// weightedRoundRobinBalancer is nginx's smooth weighted round robin. With
+// weights 5, 1 and 1 it picks a a b a c a a rather than a a a a a b c.
+type weightedRoundRobinBalancer struct {
+	mu sync.Mutex
+}
+
+func WeightedRoundRobinBalancer() Balancer { return &weightedRoundRobinBalancer{} }
+
+func (r *weightedRoundRobinBalancer) Pick(backends []*Backend) *Backend {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, b := range backends {
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+
+	best.current -= total
+	return best
+}
+
+type leastConnectionsBalancer struct{}
+
+func LeastConnectionsBalancer() Balancer { return leastConnectionsBalancer{} }
+
+// Pick starts looking at a random backend so that ties are spread out
+// instead of all going to the first backend.
+func (leastConnectionsBalancer) Pick(backends []*Backend) *Backend {
+	offset := rand.IntN(len(backends))
+
+	var best *Backend
+	for i := range backends {
+		b := backends[(offset+i)%len(backends)]
+		// a/wa < b/wb without dividing
+		if best == nil || b.Active()*int64(best.weight) < best.Active()*int64(b.weight) {
+			best = b
+		}
+	}
+	return best
+}
+
+type powerOfTwoEWMABalancer struct{}
+
+func PowerOfTwoEWMABalancer() Balancer { return powerOfTwoEWMABalancer{} }
+
+// Pick compares two distinct backends at random by latency scaled by load
+// and weight. Backends that have not served anything yet score best, so
+// new ones are tried straight away.
+func (powerOfTwoEWMABalancer) Pick(backends []*Backend) *Backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+
+	i := rand.IntN(len(backends))
+	j := rand.IntN(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := backends[i], backends[j]
+	if p2cScore(b) < p2cScore(a) {
+		return b
+	}
+	return a
+}
+
+func p2cScore(b *Backend) float64 {
+	return float64(b.Latency()+1) * float64(b.Active()+1) / float64(b.weight)
+}
+
+// LoadBalancerMember is a service in a load balanced pool. Weight defaults
+// to 1.
+type LoadBalancerMember[T any] struct {
+	Service T
+	// Identifies the member in logs, defaults to its position
+	Name   string
+	Weight int
+	// Unhealthy members are skipped, the checker is started and closed by
+	// whoever made it
+	Health *HealthChecker
+	// Backups only get traffic while every other member is unhealthy
+	Backup bool
+}
+
+type LoadBalancerConfig struct {
+	// Defaults to RandomBalancer
+	Balancer Balancer
+	// Turned off when nil
+	OutlierDetection *OutlierDetection
+}
+
+type balancerPool[T any] struct {
+	balancer Balancer
+	primary  []*Backend
+	backup   []*Backend
+	services []T
+	outliers *outlierDetector
+}
+
+func newBalancerPool[T any](config LoadBalancerConfig, members []LoadBalancerMember[T]) *balancerPool[T] {
+	pool := &balancerPool[T]{
+		balancer: config.Balancer,
+	}
+	if pool.balancer == nil {
+		pool.balancer = RandomBalancer()
+	}
+
+	for i, member := range members {
+		weight := member.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		name := member.Name
+		if name == "" {
+			name = fmt.Sprintf("backend %d", i)
+		}
+
+		backend := &Backend{
+			name:   name,
+			weight: weight,
+			index:  i,
+			health: member.Health,
+		}
+		if member.Backup {
+			pool.backup = append(pool.backup, backend)
+		} else {
+			pool.primary = append(pool.primary, backend)
+		}
+		pool.services = append(pool.services, member.Service)
+	}
+
+	if config.OutlierDetection != nil {
+		pool.outliers = newOutlierDetector(*config.OutlierDetection, slices.Concat(pool.primary, pool.backup))
+	}
+
+	return pool
+}
+
+// pick returns the service to use and the function to call once it is
+// done, with whether it failed. ok is false when no member is healthy.
+func (p *balancerPool[T]) pick() (service T, done func(failed bool), ok bool) {
+	backends := healthyBackends(p.primary)
+	if len(backends) == 0 {
+		backends = healthyBackends(p.backup)
+	}
+	if len(backends) == 0 {
+		return service, nil, false
+	}
+
+	backend := p.balancer.Pick(backends)
+	end := backend.start()
+
+	return p.services[backend.index], func(failed bool) {
+		end()
+		if p.outliers != nil {
+			p.outliers.record(backend, failed)
+		}
+	}, true
+}
+
+// healthyBackends returns backends itself while they are all healthy,
+// sparing an allocation on every pick.
+func healthyBackends(backends []*Backend) []*Backend {
+	for i, b := range backends {
+		if b.Healthy() {
+			continue
+		}
+
+		healthy := slices.Clone(backends[:i])
+		for _, b := range backends[i+1:] {
+			if b.Healthy() {
+				healthy = append(healthy, b)
+			}
+		}
+		return healthy
+	}
+	return backends
+}
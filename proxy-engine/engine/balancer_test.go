@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func testBackends(weights []int, latencies []time.Duration) []*Backend {
+	backends := make([]*Backend, len(weights))
+	for i, weight := range weights {
+		backends[i] = &Backend{weight: weight, index: i}
+		if latencies != nil {
+			backends[i].observe(time.Now(), latencies[i])
+		}
+	}
+	return backends
+}
+
+func TestBalancerDistribution(t *testing.T) {
+	tests := []struct {
+		method    BalancerMethod
+		weights   []int
+		latencies []time.Duration
+		// Keep every picked request open, as long lived connections would
+		hold  bool
+		picks int
+		want  []float64
+		// Allowed difference between the wanted and seen share
+		tolerance float64
+	}{
+		{
+			method:    BalanceRandom,
+			weights:   []int{1, 2, 3},
+			picks:     60000,
+			want:      []float64{1.0 / 6, 2.0 / 6, 3.0 / 6},
+			tolerance: 0.01,
+		},
+		{
+			method:  BalanceRoundRobin,
+			weights: []int{1, 2, 3},
+			picks:   600,
+			want:    []float64{1.0 / 3, 1.0 / 3, 1.0 / 3},
+		},
+		{
+			method:  BalanceWeightedRoundRobin,
+			weights: []int{5, 1, 1},
+			picks:   700,
+			want:    []float64{5.0 / 7, 1.0 / 7, 1.0 / 7},
+		},
+		{
+			method:  BalanceLeastConnections,
+			weights: []int{1, 3},
+			hold:    true,
+			picks:   400,
+			want:    []float64{1.0 / 4, 3.0 / 4},
+		},
+		{
+			method:    BalanceLeastConnections,
+			weights:   []int{1, 1, 1},
+			picks:     30000,
+			want:      []float64{1.0 / 3, 1.0 / 3, 1.0 / 3},
+			tolerance: 0.01,
+		},
+		{
+			// The slowest backend loses every comparison and the middle one
+			// only wins against it, which it meets in a third of the pairs
+			method:    BalancePowerOfTwoEWMA,
+			weights:   []int{1, 1, 1},
+			latencies: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond},
+			picks:     60000,
+			want:      []float64{2.0 / 3, 1.0 / 3, 0},
+			tolerance: 0.01,
+		},
+		{
+			// Weight scales latency, 40ms over 4 beats 20ms over 1
+			method:    BalancePowerOfTwoEWMA,
+			weights:   []int{1, 4},
+			latencies: []time.Duration{20 * time.Millisecond, 40 * time.Millisecond},
+			picks:     1000,
+			want:      []float64{0, 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.method, test.weights), func(t *testing.T) {
+			balancer, err := NewBalancer(test.method)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			backends := testBackends(test.weights, test.latencies)
+			counts := make([]int, len(backends))
+
+			for range test.picks {
+				b := balancer.Pick(backends)
+				counts[b.index]++
+				if test.hold {
+					b.active.Add(1)
+				}
+			}
+
+			for i, count := range counts {
+				share := float64(count) / float64(test.picks)
+				if math.Abs(share-test.want[i]) > test.tolerance+1e-9 {
+					t.Errorf("backend %d (weight %d) got %.4f of picks, want %.4f", i, test.weights[i], share, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobinSpreadsTurns(t *testing.T) {
+	backends := testBackends([]int{5, 1, 1}, nil)
+	balancer := WeightedRoundRobinBalancer()
+
+	var order []int
+	for range 7 {
+		order = append(order, balancer.Pick(backends).index)
+	}
+
+	want := []int{0, 0, 1, 0, 2, 0, 0}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("picked %v, want %v", order, want)
+		}
+	}
+}
+
+func TestPowerOfTwoEWMAPrefersIdleBackend(t *testing.T) {
+	backends := testBackends([]int{1, 1}, []time.Duration{10 * time.Millisecond, 10 * time.Millisecond})
+	backends[0].active.Add(3)
+
+	balancer := PowerOfTwoEWMABalancer()
+	for range 100 {
+		if b := balancer.Pick(backends); b != backends[1] {
+			t.Fatal("picked the busier of two backends with equal latency")
+		}
+	}
+}
@@ -18,11 +18,15 @@ type BufferedConn interface {
 	SetWriteDeadline(t time.Time) error
 	NetConn() net.Conn
 	Reader() *bufio.Reader
+	// Protocol is the label the sniffers gave the connection
+	Protocol() string
+	SetProtocol(protocol string)
 }
 
 type bufferedConn struct {
-	conn   net.Conn
-	reader *bufio.Reader
+	conn     net.Conn
+	reader   *bufio.Reader
+	protocol string
 }
 
 func NewBufferedConn(conn net.Conn) BufferedConn {
@@ -81,3 +85,11 @@ func (c *bufferedConn) NetConn() net.Conn {
 func (c *bufferedConn) Reader() *bufio.Reader {
 	return c.reader
 }
+
+func (c *bufferedConn) Protocol() string {
+	return c.protocol
+}
+
+func (c *bufferedConn) SetProtocol(protocol string) {
+	c.protocol = protocol
+}
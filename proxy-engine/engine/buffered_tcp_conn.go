@@ -2,38 +2,113 @@ package engine
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"time"
 )
 
 type BufferedTCPConn struct {
-	tcpConn *net.TCPConn
-	reader  *bufio.Reader
+	conn     net.Conn
+	reader   *bufio.Reader
+	tls      *tls.ConnectionState
+	alpn     []string
+	protocol string
+
+	// Set by load balancers to hear about backends that could not be
+	// reached
+	upstreamFailed func(err error)
+	// Set by the runtime, cancelled once the connection should drain
+	ctx context.Context
 }
 
 func NewBufferedTCPConn(bconn BufferedConn) (*BufferedTCPConn, error) {
-	tcpConn, ok := bconn.NetConn().(*net.TCPConn)
-	if !ok {
+	if conn, ok := bconn.(*BufferedTCPConn); ok {
+		return conn, nil
+	}
+
+	netConn := bconn.NetConn()
+
+	// Connections accepted with a PROXY protocol header are TCP underneath
+	underlying := netConn
+	if c, ok := underlying.(*proxyProtocolConn); ok {
+		underlying = c.NetConn()
+	}
+
+	if _, ok := underlying.(*net.TCPConn); !ok {
 		return nil, fmt.Errorf("underlying connection is not a *net.TCPConn")
 	}
 
 	return &BufferedTCPConn{
-		tcpConn: tcpConn,
-		reader:  bconn.Reader(),
+		conn:     netConn,
+		reader:   bconn.Reader(),
+		protocol: bconn.Protocol(),
 	}, nil
 }
 
+// NewBufferedTLSConn wraps a TLS connection the proxy terminated, reads
+// and writes are plaintext. offered are the protocols the client asked
+// for in its ClientHello.
+func NewBufferedTLSConn(conn *tls.Conn, offered []string) *BufferedTCPConn {
+	state := conn.ConnectionState()
+	return &BufferedTCPConn{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		tls:      &state,
+		alpn:     offered,
+		protocol: SniffTLS,
+	}
+}
+
+// TLS returns the state of the TLS the proxy terminated, or nil when the
+// connection is passed through as is.
+func (c *BufferedTCPConn) TLS() *tls.ConnectionState {
+	return c.tls
+}
+
+// ALPN returns the negotiated protocol, or every protocol the client
+// offered when none was negotiated.
+func (c *BufferedTCPConn) ALPN() []string {
+	if c.tls != nil && c.tls.NegotiatedProtocol != "" {
+		return []string{c.tls.NegotiatedProtocol}
+	}
+	return c.alpn
+}
+
+func (b *BufferedTCPConn) Protocol() string {
+	return b.protocol
+}
+
+func (b *BufferedTCPConn) SetProtocol(protocol string) {
+	b.protocol = protocol
+}
+
+// Context is cancelled once the connection should start draining, work
+// done on its behalf such as dialing the upstream should stop with it.
+func (b *BufferedTCPConn) Context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+func (b *BufferedTCPConn) reportUpstreamFailure(err error) {
+	if b.upstreamFailed != nil {
+		b.upstreamFailed(err)
+	}
+}
+
 func (b *BufferedTCPConn) Read(p []byte) (n int, err error) {
 	return b.reader.Read(p)
 }
 
 func (b *BufferedTCPConn) Write(p []byte) (n int, err error) {
-	return b.tcpConn.Write(p)
+	return b.conn.Write(p)
 }
 
 func (b *BufferedTCPConn) NetConn() net.Conn {
-	return b.tcpConn
+	return b.conn
 }
 
 func (c *BufferedTCPConn) Peek(n int) ([]byte, error) {
@@ -45,25 +120,25 @@ func (c *BufferedTCPConn) Reader() *bufio.Reader {
 }
 
 func (c *BufferedTCPConn) Close() error {
-	return c.tcpConn.Close()
+	return c.conn.Close()
 }
 
 func (c *BufferedTCPConn) LocalAddr() net.Addr {
-	return c.tcpConn.LocalAddr()
+	return c.conn.LocalAddr()
 }
 
 func (c *BufferedTCPConn) RemoteAddr() net.Addr {
-	return c.tcpConn.RemoteAddr()
+	return c.conn.RemoteAddr()
 }
 
 func (c *BufferedTCPConn) SetDeadline(t time.Time) error {
-	return c.tcpConn.SetDeadline(t)
+	return c.conn.SetDeadline(t)
 }
 
 func (c *BufferedTCPConn) SetReadDeadline(t time.Time) error {
-	return c.tcpConn.SetReadDeadline(t)
+	return c.conn.SetReadDeadline(t)
 }
 
 func (c *BufferedTCPConn) SetWriteDeadline(t time.Time) error {
-	return c.tcpConn.SetWriteDeadline(t)
+	return c.conn.SetWriteDeadline(t)
 }
@@ -0,0 +1,267 @@
+package engine
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const certStoreReloadDebounce = 250 * time.Millisecond
+
+var certExtensions = []string{".crt", ".cer", ".pem"}
+
+type CertStoreConfig struct {
+	Dir string
+	// Base name of the pair served when no certificate matches the SNI,
+	// e.g. "default" for default.crt and default.key
+	Default string
+}
+
+// CertStore serves certificates from a directory, picking one by the SNI
+// of each handshake. Every name.crt, name.cer or name.pem is paired with
+// name.key, or holds its own key when there is none. Certificates are
+// indexed by their SANs, wildcards included, and the directory is reloaded
+// whenever it changes.
+type CertStore struct {
+	config  CertStoreConfig
+	index   atomic.Pointer[certIndex]
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type certIndex struct {
+	// Pairs by base name, kept so a pair that fails to reload can fall
+	// back to its previous version
+	pairs    map[string]*tls.Certificate
+	exact    map[string]*tls.Certificate
+	wildcard map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func NewCertStore(config CertStoreConfig) (*CertStore, error) {
+	s := &CertStore{
+		config: config,
+		done:   make(chan struct{}),
+	}
+
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Default != "" && s.index.Load().fallback == nil {
+		return nil, fmt.Errorf("Default certificate \"%s\" not found in %s", config.Default, config.Dir)
+	}
+
+	s.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.watcher.Add(config.Dir)
+	if err != nil {
+		s.watcher.Close()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.watch()
+
+	return s, nil
+}
+
+func (s *CertStore) HandleTLSConfig(info *tls.ClientHelloInfo) (*tls.Config, error) {
+	cert := s.Certificate(info.ServerName)
+	if cert == nil {
+		return nil, fmt.Errorf("No certificate for \"%s\"", info.ServerName)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// Certificate returns the certificate for a server name. An exact SAN
+// wins over a wildcard, which wins over the default certificate.
+func (s *CertStore) Certificate(serverName string) *tls.Certificate {
+	index := s.index.Load()
+	if cert := index.match(serverName); cert != nil {
+		return cert
+	}
+
+	return index.fallback
+}
+
+// MatchesServerName reports whether a SAN covers the server name, the
+// default certificate does not count.
+func (s *CertStore) MatchesServerName(serverName string) bool {
+	return s.index.Load().match(serverName) != nil
+}
+
+// Reload rereads the directory. Pairs that fail to load keep their
+// previous version when there is one.
+func (s *CertStore) Reload() error {
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	previous := s.index.Load()
+
+	index := &certIndex{
+		pairs:    make(map[string]*tls.Certificate),
+		exact:    make(map[string]*tls.Certificate),
+		wildcard: make(map[string]*tls.Certificate),
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if strings.HasPrefix(name, ".") || !isCertFile(ext) {
+			continue
+		}
+
+		base := strings.TrimSuffix(name, ext)
+		if _, loaded := index.pairs[base]; loaded {
+			continue
+		}
+
+		cert, err := loadCertPair(filepath.Join(s.config.Dir, name), filepath.Join(s.config.Dir, base+".key"))
+		if err != nil {
+			log.Printf("%s | Failed to load certificate with error: %s\n", filepath.Join(s.config.Dir, name), err)
+			if previous == nil || previous.pairs[base] == nil {
+				continue
+			}
+			cert = previous.pairs[base]
+		}
+
+		index.pairs[base] = cert
+	}
+
+	for _, base := range slices.Sorted(maps.Keys(index.pairs)) {
+		cert := index.pairs[base]
+		index.add(cert)
+		if base == s.config.Default {
+			index.fallback = cert
+		}
+	}
+
+	s.index.Store(index)
+
+	return nil
+}
+
+// Close stops watching the directory.
+func (s *CertStore) Close() error {
+	close(s.done)
+	err := s.watcher.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *CertStore) watch() {
+	defer s.wg.Done()
+
+	timer := time.NewTimer(certStoreReloadDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			timer.Reset(certStoreReloadDebounce)
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("%s | Certificate watcher error: %s\n", s.config.Dir, err)
+		case <-timer.C:
+			err := s.Reload()
+			if err != nil {
+				log.Printf("%s | Failed to reload certificates with error: %s\n", s.config.Dir, err)
+				continue
+			}
+			log.Printf("%s | Reloaded %d certificates\n", s.config.Dir, len(s.index.Load().pairs))
+		}
+	}
+}
+
+// add indexes a certificate under every name it is valid for. When two
+// certificates cover the same name the one that expires last wins.
+// match returns the certificate with an exact SAN for the name, or
+// else one with a wildcard SAN.
+func (i *certIndex) match(serverName string) *tls.Certificate {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+
+	if cert, ok := i.exact[name]; ok {
+		return cert
+	}
+
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := i.wildcard[parent]; ok {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+func (i *certIndex) add(cert *tls.Certificate) {
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+
+		table := i.exact
+		if parent, ok := strings.CutPrefix(name, "*."); ok {
+			table = i.wildcard
+			name = parent
+		}
+
+		if existing, ok := table[name]; ok && existing.Leaf.NotAfter.After(cert.Leaf.NotAfter) {
+			continue
+		}
+		table[name] = cert
+	}
+}
+
+func isCertFile(ext string) bool {
+	return slices.Contains(certExtensions, strings.ToLower(ext))
+}
+
+// loadCertPair loads a certificate and its key, or a single file holding
+// both when the key file does not exist.
+func loadCertPair(certFile string, keyFile string) (*tls.Certificate, error) {
+	if _, err := os.Stat(keyFile); err != nil {
+		keyFile = certFile
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+type ClientAuthMode string
+
+const (
+	// Client certificates are not asked for
+	ClientAuthNone ClientAuthMode = "none"
+	// Client certificates are asked for but optional, when given they must
+	// verify against the policy's CAs
+	ClientAuthRequest ClientAuthMode = "request"
+	// A client certificate signed by one of the policy's CAs is required
+	ClientAuthRequire ClientAuthMode = "require"
+)
+
+type ClientAuthPolicy struct {
+	Mode ClientAuthMode
+	CAs  *x509.CertPool
+}
+
+func (p ClientAuthPolicy) apply(config *tls.Config) {
+	switch p.Mode {
+	case ClientAuthRequest:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		config.ClientAuth = tls.NoClientCert
+	}
+	config.ClientCAs = p.CAs
+}
+
+// ClientAuth applies a client auth policy on top of the configs returned
+// by handler, picked by the server name of each handshake. Policies are
+// keyed by server name, "*.example.com" covers one level of subdomains
+// and "" covers every name without a policy of its own.
+func ClientAuth(handler TLSConfigHandler, policies map[string]ClientAuthPolicy) TLSConfigHandler {
+	return TLSConfigHandlerFunc(func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		config, err := handler.HandleTLSConfig(info)
+		if err != nil {
+			return nil, err
+		}
+
+		// TLS-ALPN-01 validation connections come from the ACME server,
+		// which has no client certificate to present. Only configs that
+		// can negotiate nothing else are let through, and the server
+		// closes those connections after the handshake.
+		if slices.Equal(config.NextProtos, []string{acme.ALPNProto}) {
+			return config, nil
+		}
+
+		policy, ok := clientAuthPolicy(policies, info.ServerName)
+		if !ok {
+			return config, nil
+		}
+
+		config = config.Clone()
+		policy.apply(config)
+
+		return config, nil
+	})
+}
+
+// ClientAuthHost answers 421 Misdirected Request to requests whose Host
+// falls under a different client auth policy than the server name their
+// connection was handshaken with. Without it a client could handshake for
+// a name without a policy and then ask for one that has one.
+func ClientAuthHost(policies map[string]ClientAuthPolicy) Middleware {
+	return MiddlewareFunc(func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+		if r.TLS == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		policy, ok := clientAuthPolicy(policies, host)
+		if ok {
+			handshake, handshakeOk := clientAuthPolicy(policies, r.TLS.ServerName)
+			if !handshakeOk || handshake != policy {
+				http.Error(w, "misdirected request", http.StatusMisdirectedRequest)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func clientAuthPolicy(policies map[string]ClientAuthPolicy, serverName string) (ClientAuthPolicy, bool) {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+
+	if policy, ok := policies[name]; ok {
+		return policy, true
+	}
+
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if policy, ok := policies["*."+parent]; ok {
+			return policy, true
+		}
+	}
+
+	policy, ok := policies[""]
+	return policy, ok
+}
+
+// verifiedClientCert returns the leaf of the first verified chain of the
+// connection, unverified peer certificates are never trusted.
+func verifiedClientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// CertFingerprint is the lowercase hex SHA-256 of a certificate.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// handshake runs a TLS handshake between a server using policy and a
+// client presenting clientCert, returning the server side state.
+func handshake(t *testing.T, policy ClientAuthPolicy, serverCert, clientCert tls.Certificate) (*tls.ConnectionState, error) {
+	t.Helper()
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	policy.apply(serverConfig)
+
+	clientConfig := &tls.Config{InsecureSkipVerify: true, ServerName: "admin.test"}
+	if clientCert.Certificate != nil {
+		// Send the certificate even when the server did not ask for its
+		// issuer, as a forging client would
+		clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &clientCert, nil
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	serverConn.SetDeadline(deadline)
+	clientConn.SetDeadline(deadline)
+
+	server := tls.Server(serverConn, serverConfig)
+	client := tls.Client(clientConn, clientConfig)
+
+	go func() {
+		// The server only reads the client's certificate once the client
+		// sends past its handshake in TLS 1.3
+		if client.Handshake() == nil {
+			client.Write([]byte{0})
+		}
+	}()
+
+	if err := server.Handshake(); err != nil {
+		return nil, err
+	}
+	if _, err := server.Read(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+
+	state := server.ConnectionState()
+	return &state, nil
+}
+
+func TestClientAuthRequestDoesNotTrustForgedCert(t *testing.T) {
+	ca, caKey := newTestCert(t, "test ca", nil, nil, true)
+	serverCert, serverKey := newTestCert(t, "admin.test", ca, caKey, false)
+	trusted, trustedKey := newTestCert(t, "admin", ca, caKey, false)
+	forged, forgedKey := newTestCert(t, "admin", nil, nil, false)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	policy := ClientAuthPolicy{Mode: ClientAuthRequest, CAs: pool}
+
+	rule := ClientCertSubject("admin")
+
+	state, err := handshake(t, policy, tlsCertificate(serverCert, serverKey), tlsCertificate(trusted, trustedKey))
+	if err != nil {
+		t.Fatalf("handshake with trusted cert: %v", err)
+	}
+	if !rule.Match(&TCPContext{TLS: state}) {
+		t.Error("verified cert did not match ClientCertSubject")
+	}
+
+	if _, err := handshake(t, policy, tlsCertificate(serverCert, serverKey), tlsCertificate(forged, forgedKey)); err == nil {
+		t.Error("handshake with forged cert succeeded")
+	}
+
+	state, err = handshake(t, policy, tlsCertificate(serverCert, serverKey), tls.Certificate{})
+	if err != nil {
+		t.Fatalf("handshake without cert: %v", err)
+	}
+	if rule.Match(&TCPContext{TLS: state}) {
+		t.Error("connection without cert matched ClientCertSubject")
+	}
+}
+
+func TestClientCertIgnoresUnverifiedPeerCertificates(t *testing.T) {
+	forged, _ := newTestCert(t, "admin", nil, nil, false)
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{forged}}
+
+	if ClientCertSubject("admin").Match(&TCPContext{TLS: state}) {
+		t.Error("unverified cert matched ClientCertSubject")
+	}
+	if ClientCertFingerprint(CertFingerprint(forged)).Match(&TCPContext{TLS: state}) {
+		t.Error("unverified cert matched ClientCertFingerprint")
+	}
+
+	var forwarded string
+	handler := ForwardClientCert().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(ForwardedClientCertHeader)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "https://admin.test/", nil)
+	r.TLS = state
+	r.Header.Set(ForwardedClientCertHeader, "Subject=\"CN=admin\"")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if forwarded != "" {
+		t.Errorf("forwarded %q for an unverified cert", forwarded)
+	}
+
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{forged}}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if forwarded == "" {
+		t.Error("verified cert was not forwarded")
+	}
+}
+
+func TestClientAuthHostMisdirected(t *testing.T) {
+	policies := map[string]ClientAuthPolicy{
+		"admin.w.test": {Mode: ClientAuthRequire, CAs: x509.NewCertPool()},
+	}
+	handler := ClientAuthHost(policies).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		sni, host string
+		status    int
+	}{
+		{"x.w.test", "admin.w.test", http.StatusMisdirectedRequest},
+		{"", "admin.w.test:443", http.StatusMisdirectedRequest},
+		{"admin.w.test", "admin.w.test", http.StatusOK},
+		{"admin.w.test", "ADMIN.w.test:443", http.StatusOK},
+		{"x.w.test", "y.w.test", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "https://"+test.host+"/", nil)
+		r.Host = test.host
+		r.TLS = &tls.ConnectionState{ServerName: test.sni}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("sni %q host %q: status %d, want %d", test.sni, test.host, w.Code, test.status)
+		}
+	}
+}
+
+func TestClientAuthSkipsOnlyALPNChallenges(t *testing.T) {
+	ca, _ := newTestCert(t, "ca.test", nil, nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	policies := map[string]ClientAuthPolicy{
+		"admin.test": {Mode: ClientAuthRequire, CAs: pool},
+	}
+
+	tests := []struct {
+		name string
+		// What the wrapped handler negotiates
+		protos []string
+		want   tls.ClientAuthType
+	}{
+		{"challenge", []string{acme.ALPNProto}, tls.NoClientCert},
+		{"challenge offered to a non ACME handler", []string{"h2", "http/1.1"}, tls.RequireAndVerifyClientCert},
+		{"challenge among other protocols", []string{acme.ALPNProto, "h2"}, tls.RequireAndVerifyClientCert},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := ClientAuth(TLSConfigHandlerFunc(func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return &tls.Config{NextProtos: test.protos}, nil
+			}), policies)
+
+			config, err := handler.HandleTLSConfig(&tls.ClientHelloInfo{
+				ServerName:      "admin.test",
+				SupportedProtos: []string{acme.ALPNProto, "h2"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ClientAuth != test.want {
+				t.Errorf("client auth %s, want %s", config.ClientAuth, test.want)
+			}
+		})
+	}
+}
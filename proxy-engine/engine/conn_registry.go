@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+type connRegistry struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Add tracks conn until Remove is called. It reports false once the
+// registry has been closed and no new connections should be served.
+func (r *connRegistry) Add(conn net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+
+	r.conns[conn] = struct{}{}
+	r.wg.Add(1)
+	return true
+}
+
+func (r *connRegistry) Remove(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.conns[conn]; !ok {
+		return
+	}
+
+	delete(r.conns, conn)
+	r.wg.Done()
+}
+
+func (r *connRegistry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+func (r *connRegistry) CloseAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for conn := range r.conns {
+		conn.Close()
+	}
+}
+
+func (r *connRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// Wait blocks until every tracked connection has been removed or ctx is
+// done, whichever happens first.
+func (r *connRegistry) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,24 @@
+package engine
+
+import "time"
+
+type DrainMode string
+
+const (
+	// Close every connection as soon as the entrypoint is removed
+	DrainImmediate DrainMode = "immediate"
+	// Let connections finish for up to Timeout before closing them
+	DrainGrace DrainMode = "grace"
+	// Wait for every connection to finish on its own
+	DrainWait DrainMode = "wait"
+)
+
+type DrainPolicy struct {
+	Mode    DrainMode
+	Timeout time.Duration
+}
+
+var DefaultDrainPolicy = DrainPolicy{
+	Mode:    DrainGrace,
+	Timeout: 30 * time.Second,
+}
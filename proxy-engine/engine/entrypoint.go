@@ -1,10 +1,20 @@
 package engine
 
 import (
+	"context"
 	"net"
+	"time"
 )
 
 type EntryPoint interface {
 	Id() string
 	Listen() (net.Listener, error)
 }
+
+type entryPointState struct {
+	listener net.Listener
+	conns    *connRegistry
+	drain    context.CancelFunc
+	// Zero when silent connections are not labelled SniffServerFirst
+	serverFirstTimeout time.Duration
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cUpgrade switches requests carrying "Upgrade: h2c" over to cleartext
+// HTTP/2 (RFC 7540 section 3.2). The upgrading request is answered as
+// stream 1 of the new connection. Prior knowledge h2c never gets here,
+// http.Server picks up the connection preface itself.
+func h2cUpgrade(next http.Handler) http.Handler {
+	h2 := &http2.Server{}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings, ok := h2cUpgradeSettings(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			return
+		}
+
+		// Upgraded connections are no longer tracked by http.Server, so a
+		// draining server closes them rather than waiting on them
+		h2.ServeConn(&h2cConn{Conn: conn, reader: rw.Reader}, &http2.ServeConnOpts{
+			Context:        r.Context(),
+			Handler:        next,
+			UpgradeRequest: r,
+			Settings:       settings,
+		})
+	})
+}
+
+// h2cUpgradeSettings decodes the HTTP2-Settings of a valid upgrade
+// request. Requests with a body are served over HTTP/1, which the RFC
+// allows, as the body would have to be read before switching.
+func h2cUpgradeSettings(r *http.Request) ([]byte, bool) {
+	if r.TLS != nil || r.ProtoMajor != 1 || r.ContentLength != 0 {
+		return nil, false
+	}
+
+	if !headerHasToken(r.Header, "Upgrade", "h2c") ||
+		!headerHasToken(r.Header, "Connection", "Upgrade") ||
+		!headerHasToken(r.Header, "Connection", "HTTP2-Settings") {
+		return nil, false
+	}
+
+	values := r.Header.Values("HTTP2-Settings")
+	if len(values) != 1 {
+		return nil, false
+	}
+
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil {
+		return nil, false
+	}
+
+	return settings, true
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// h2cConn reads through the buffer http.Server may already have filled
+// with the start of the HTTP/2 stream.
+type h2cConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *h2cConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
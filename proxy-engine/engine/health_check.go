@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+)
+
+// HealthProbe checks a backend once, erroring with why it is unhealthy.
+type HealthProbe interface {
+	Probe(ctx context.Context) error
+}
+
+type HealthProbeFunc func(ctx context.Context) error
+
+func (f HealthProbeFunc) Probe(ctx context.Context) error { return f(ctx) }
+
+type HealthCheckConfig struct {
+	// Identifies the backend in logs
+	Name     string
+	Probe    HealthProbe
+	Interval time.Duration
+	Timeout  time.Duration
+	// Consecutive passing checks for an unhealthy backend to become healthy
+	Rise int
+	// Consecutive failing checks for a healthy backend to become unhealthy
+	Fall int
+	// Called after every change of health
+	OnChange func(status HealthStatus)
+}
+
+type HealthStatus struct {
+	Name      string
+	Healthy   bool
+	Successes int
+	Failures  int
+	Checked   time.Time
+	// Why the last check failed, nil when it passed
+	Err error
+}
+
+// HealthChecker probes a backend on an interval once started. Backends
+// start out healthy so that traffic flows while the first checks run, and
+// only change state after Rise or Fall checks in a row agree.
+type HealthChecker struct {
+	config  HealthCheckConfig
+	healthy atomic.Bool
+
+	mu     sync.Mutex
+	status HealthStatus
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewHealthChecker(config HealthCheckConfig) *HealthChecker {
+	if config.Interval <= 0 {
+		config.Interval = DefaultHealthCheckInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultHealthCheckTimeout
+	}
+	if config.Rise <= 0 {
+		config.Rise = DefaultHealthCheckRise
+	}
+	if config.Fall <= 0 {
+		config.Fall = DefaultHealthCheckFall
+	}
+
+	c := &HealthChecker{
+		config: config,
+		status: HealthStatus{
+			Name:    config.Name,
+			Healthy: true,
+		},
+		done: make(chan struct{}),
+	}
+	c.healthy.Store(true)
+
+	return c
+}
+
+func (c *HealthChecker) Healthy() bool {
+	return c.healthy.Load()
+}
+
+func (c *HealthChecker) Status() HealthStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// Start begins checking in the background, the first check runs straight
+// away. Calling it again does nothing.
+func (c *HealthChecker) Start() {
+	c.startOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		c.mu.Lock()
+		c.cancel = cancel
+		c.mu.Unlock()
+
+		go c.run(ctx)
+	})
+}
+
+// Close stops checking and waits for a check in flight to finish. A closed
+// checker keeps the health it last had.
+func (c *HealthChecker) Close() error {
+	c.closeOnce.Do(func() {
+		// Stops a later Start from running
+		c.startOnce.Do(func() {
+			close(c.done)
+		})
+
+		c.mu.Lock()
+		cancel := c.cancel
+		c.mu.Unlock()
+
+		if cancel != nil {
+			cancel()
+			<-c.done
+		}
+	})
+	return nil
+}
+
+func (c *HealthChecker) run(ctx context.Context) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *HealthChecker) check(ctx context.Context) {
+	probeCtx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	err := c.config.Probe.Probe(probeCtx)
+	cancel()
+
+	// Checks cut short by Close say nothing about the backend
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.mu.Lock()
+	status := &c.status
+	status.Checked = time.Now()
+	status.Err = err
+
+	changed := false
+	if err == nil {
+		status.Successes++
+		status.Failures = 0
+		if !status.Healthy && status.Successes >= c.config.Rise {
+			status.Healthy = true
+			changed = true
+		}
+	} else {
+		status.Failures++
+		status.Successes = 0
+		if status.Healthy && status.Failures >= c.config.Fall {
+			status.Healthy = false
+			changed = true
+		}
+	}
+	c.healthy.Store(status.Healthy)
+	snapshot := *status
+	c.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if snapshot.Healthy {
+		log.Printf("%s | Backend is healthy after %d passing checks\n", snapshot.Name, snapshot.Successes)
+	} else {
+		log.Printf("%s | Backend is unhealthy after %d failing checks, last with error: %s\n", snapshot.Name, snapshot.Failures, snapshot.Err)
+	}
+
+	if c.config.OnChange != nil {
+		c.config.OnChange(snapshot)
+	}
+}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// switchProbe passes or fails as it is told.
+type switchProbe struct {
+	failing atomic.Bool
+}
+
+func (p *switchProbe) Probe(ctx context.Context) error {
+	if p.failing.Load() {
+		return errors.New("probe failed")
+	}
+	return nil
+}
+
+func TestHealthCheckerRiseAndFall(t *testing.T) {
+	quietLog(t)
+
+	probe := &switchProbe{}
+	var changes []HealthStatus
+	checker := NewHealthChecker(HealthCheckConfig{
+		Name:     "backend",
+		Probe:    probe,
+		Rise:     2,
+		Fall:     3,
+		OnChange: func(status HealthStatus) { changes = append(changes, status) },
+	})
+
+	steps := []struct {
+		failing bool
+		healthy bool
+	}{
+		// Fall needs three failures in a row, a pass resets the count
+		{true, true},
+		{true, true},
+		{false, true},
+		{true, true},
+		{true, true},
+		{true, false},
+		// Rise needs two passes in a row, a failure resets the count
+		{false, false},
+		{true, false},
+		{false, false},
+		{false, true},
+	}
+
+	for i, step := range steps {
+		probe.failing.Store(step.failing)
+		checker.check(context.Background())
+
+		if checker.Healthy() != step.healthy {
+			t.Fatalf("check %d: healthy %t, want %t", i, checker.Healthy(), step.healthy)
+		}
+		if status := checker.Status(); status.Healthy != step.healthy || (status.Err != nil) != step.failing {
+			t.Fatalf("check %d: status %+v", i, status)
+		}
+	}
+
+	if len(changes) != 2 || changes[0].Healthy || !changes[1].Healthy {
+		t.Errorf("changes %+v, want unhealthy then healthy", changes)
+	}
+}
+
+func TestBalancerPoolFallsBackToBackups(t *testing.T) {
+	quietLog(t)
+
+	probes := []*switchProbe{{}, {}, {}}
+	var members []LoadBalancerMember[string]
+	for i, name := range []string{"primary-a", "primary-b", "backup"} {
+		members = append(members, LoadBalancerMember[string]{
+			Service: name,
+			Health:  NewHealthChecker(HealthCheckConfig{Probe: probes[i], Rise: 1, Fall: 1}),
+			Backup:  name == "backup",
+		})
+	}
+
+	pool := newBalancerPool(LoadBalancerConfig{Balancer: RoundRobinBalancer()}, members)
+
+	setFailing := func(failing ...bool) {
+		for i, probe := range probes {
+			probe.failing.Store(failing[i])
+			members[i].Health.check(context.Background())
+		}
+	}
+
+	picked := func() map[string]int {
+		counts := make(map[string]int)
+		for range 10 {
+			service, done, ok := pool.pick()
+			if !ok {
+				counts[""]++
+				continue
+			}
+			counts[service]++
+			done(false)
+		}
+		return counts
+	}
+
+	tests := []struct {
+		failing []bool
+		want    map[string]int
+	}{
+		{[]bool{false, false, false}, map[string]int{"primary-a": 5, "primary-b": 5}},
+		{[]bool{true, false, false}, map[string]int{"primary-b": 10}},
+		{[]bool{true, true, false}, map[string]int{"backup": 10}},
+		{[]bool{true, true, true}, map[string]int{"": 10}},
+		{[]bool{false, true, false}, map[string]int{"primary-a": 10}},
+	}
+
+	for _, test := range tests {
+		setFailing(test.failing...)
+
+		got := picked()
+		if len(got) != len(test.want) {
+			t.Fatalf("failing %v: picked %v, want %v", test.failing, got, test.want)
+		}
+		for service, count := range test.want {
+			if got[service] != count {
+				t.Fatalf("failing %v: picked %v, want %v", test.failing, got, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// Only the start of a response body is matched against
+const healthProbeMaxBody = 64 * 1024
+
+type HTTPHealthProbeConfig struct {
+	URL string
+	// Defaults to accepting any 2xx or 3xx status
+	Status int
+	// Matched against the start of the response body when set
+	Body *regexp.Regexp
+	// Used for https URLs, so backends are verified as the proxy verifies
+	// them
+	TLS *tls.Config
+}
+
+// HTTPHealthProbe sends a GET request to the URL. Redirects are not
+// followed and every probe opens a new connection, so a backend that has
+// stopped accepting them is caught.
+func HTTPHealthProbe(config HTTPHealthProbeConfig) HealthProbe {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   config.TLS,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return HealthProbeFunc(func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.URL, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if config.Status != 0 && resp.StatusCode != config.Status {
+			return fmt.Errorf("Expected status %d, got %d", config.Status, resp.StatusCode)
+		}
+		if config.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+			return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+		}
+
+		if config.Body == nil {
+			return nil
+		}
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, healthProbeMaxBody))
+		if err != nil {
+			return err
+		}
+		if !config.Body.Match(body) {
+			return fmt.Errorf("Body does not match %q", config.Body)
+		}
+
+		return nil
+	})
+}
+
+// TCPHealthProbe passes when a connection to address is accepted.
+func TCPHealthProbe(address string) HealthProbe {
+	return HealthProbeFunc(func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// MinecraftHealthProbe asks a Java edition server for its status, as the
+// multiplayer server list does, and passes when it answers with JSON.
+func MinecraftHealthProbe(address string) HealthProbe {
+	const (
+		// Servers answer status requests whatever version is sent, -1 is
+		// what clients send when they do not know it yet
+		statusProtocolVersion = -1
+		statusState           = 1
+		maxStatusLength       = 1 << 20
+	)
+
+	return HealthProbeFunc(func(ctx context.Context) error {
+		host, portString, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			return fmt.Errorf("Invalid port \"%s\"", portString)
+		}
+
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		handshake := []byte{0x00}
+		handshake = appendVarInt(handshake, statusProtocolVersion)
+		handshake = appendVarInt(handshake, len(host))
+		handshake = append(handshake, host...)
+		handshake = binary.BigEndian.AppendUint16(handshake, uint16(port))
+		handshake = appendVarInt(handshake, statusState)
+
+		packets := appendVarInt(nil, len(handshake))
+		packets = append(packets, handshake...)
+		// Status request, a packet holding nothing but its id
+		packets = append(packets, 0x01, 0x00)
+
+		if _, err := conn.Write(packets); err != nil {
+			return err
+		}
+
+		reader := bufio.NewReader(conn)
+
+		length, err := readVarInt(reader)
+		if err != nil {
+			return err
+		}
+		if length <= 0 || length > maxStatusLength {
+			return fmt.Errorf("Invalid status response length %d", length)
+		}
+
+		response := make([]byte, length)
+		if _, err := io.ReadFull(reader, response); err != nil {
+			return err
+		}
+
+		id, n, err := decodeVarInt(response)
+		if err != nil {
+			return err
+		}
+		if id != 0x00 {
+			return fmt.Errorf("Expected status response, got packet %d", id)
+		}
+		response = response[n:]
+
+		jsonLength, n, err := decodeVarInt(response)
+		if err != nil {
+			return err
+		}
+		response = response[n:]
+		if jsonLength != len(response) {
+			return errors.New("Status response length mismatch")
+		}
+
+		var status map[string]json.RawMessage
+		if err := json.Unmarshal(response, &status); err != nil {
+			return fmt.Errorf("Invalid status JSON: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func appendVarInt(data []byte, value int) []byte {
+	v := uint32(value)
+	for v >= 0x80 {
+		data = append(data, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(data, byte(v))
+}
+
+func readVarInt(reader io.ByteReader) (int, error) {
+	var value uint32
+	for i := range 5 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return int(int32(value)), nil
+		}
+	}
+	return 0, errors.New("VarInt too large")
+}
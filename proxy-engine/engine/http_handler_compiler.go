@@ -3,9 +3,12 @@ package engine
 import (
 	"log"
 	"net/http"
+	"slices"
+	"sync"
 )
 
 type HTTPHandlerCompiler struct {
+	mu       sync.RWMutex
 	routers  map[string]HTTPRouter
 	services map[string]http.Handler
 }
@@ -18,66 +21,95 @@ func NewHTTPHandlerCompiler() *HTTPHandlerCompiler {
 }
 
 func (c *HTTPHandlerCompiler) RegisterService(serviceId string, service http.Handler) *HTTPHandlerCompiler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.services[serviceId] = service
 	return c
 }
 
 func (c *HTTPHandlerCompiler) DeregisterService(serviceId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	delete(c.services, serviceId)
 }
 
 func (c *HTTPHandlerCompiler) Service(serviceId string) http.Handler {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.services[serviceId]
 }
 
 func (c *HTTPHandlerCompiler) Router(routerId string) HTTPRouter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.routers[routerId]
 }
 
 func (c *HTTPHandlerCompiler) RegisterRouter(routerId string) HTTPRouter {
 	router := NewHTTPRouter()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.routers[routerId] = router
 	return router
 }
 
 func (c *HTTPHandlerCompiler) DeregisterRouter(routerId string, router HTTPRouter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	delete(c.routers, routerId)
 }
 
+type compiledHTTPRoute struct {
+	routerId string
+	routeId  string
+	route    *HTTPRoute
+	handler  http.Handler
+}
+
+// Compile snapshots the given routers and the services they point at into
+// an immutable handler. Later registrations only take effect once the
+// handler is compiled and registered again.
 func (c *HTTPHandlerCompiler) Compile(routerIds ...string) http.Handler {
-	type routerWrapper struct {
-		Router HTTPRouter
-		Id     string
-	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	var routers []routerWrapper
+	var table []compiledHTTPRoute
+
+	for _, routerId := range routerIds {
+		router, ok := c.routers[routerId]
+		if !ok {
+			continue
+		}
 
-	for _, id := range routerIds {
-		router, ok := c.routers[id]
-		if ok {
-			routers = append(routers, routerWrapper{
-				Router: router,
-				Id:     id,
+		routes := router.Routes()
+		for _, routeId := range orderRoutes(routes) {
+			route := routes[routeId]
+			table = append(table, compiledHTTPRoute{
+				routerId: routerId,
+				routeId:  routeId,
+				route:    route,
+				handler:  c.wrapService(router.Middleware(), route),
 			})
 		}
 	}
 
+	// Routes from every router compete on priority, routers listed first
+	// only win ties between routes that share an id
+	slices.SortStableFunc(table, func(a, b compiledHTTPRoute) int {
+		return compareRoutes(a.routeId, a.route, b.routeId, b.route)
+	})
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var route *HTTPRoute
-		var router HTTPRouter
-		var routerId string
-		var routeId string
-
-		for _, rw := range routers {
-			routeId, route = rw.Router.Match(r)
-			router = rw.Router
-			routerId = rw.Id
-			if route != nil {
+		var match *compiledHTTPRoute
+
+		for i := range table {
+			if table[i].route.Rule.Match(r) {
+				match = &table[i]
 				break
 			}
 		}
 
-		if route == nil {
+		if match == nil {
 			http.NotFound(w, r)
 			return
 		}
@@ -85,12 +117,11 @@ func (c *HTTPHandlerCompiler) Compile(routerIds ...string) http.Handler {
 		log.Printf(
 			"%s | HTTP router \"%s\" routing request to \"%s\"\n",
 			r.RemoteAddr,
-			routerId,
-			routeId,
+			match.routerId,
+			match.routeId,
 		)
 
-		service, ok := c.services[route.ServiceId]
-		if !ok {
+		if match.handler == nil {
 			http.Error(w, "service not available", http.StatusBadGateway)
 			return
 		}
@@ -98,19 +129,27 @@ func (c *HTTPHandlerCompiler) Compile(routerIds ...string) http.Handler {
 		log.Printf(
 			"%s | \"%s\" serving \"%s\" service",
 			r.RemoteAddr,
-			routeId,
-			route.ServiceId,
+			match.routeId,
+			match.route.ServiceId,
 		)
 
-		if router.Middleware() != nil && route.Middleware != nil {
-			router.Middleware().Wrap(route.Middleware.Wrap(service)).ServeHTTP(w, r)
-			return
-		} else if router.Middleware() != nil {
-			router.Middleware().Wrap(service).ServeHTTP(w, r)
-		} else if route.Middleware != nil {
-			route.Middleware.Wrap(service).ServeHTTP(w, r)
-		} else {
-			service.ServeHTTP(w, r)
-		}
+		match.handler.ServeHTTP(w, r)
 	})
 }
+
+func (c *HTTPHandlerCompiler) wrapService(routerMiddleware Middleware, route *HTTPRoute) http.Handler {
+	service, ok := c.services[route.ServiceId]
+	if !ok {
+		return nil
+	}
+
+	if route.Middleware != nil {
+		service = route.Middleware.Wrap(service)
+	}
+
+	if routerMiddleware != nil {
+		service = routerMiddleware.Wrap(service)
+	}
+
+	return service
+}
@@ -4,4 +4,14 @@ type HTTPRoute struct {
 	Rule       Rule
 	Middleware Middleware
 	ServiceId  string
+	// Routes with a higher priority are matched first. Zero derives the
+	// priority from the rule, see RulePriority.
+	Priority int
+}
+
+func (r *HTTPRoute) priority() int {
+	if r.Priority != 0 {
+		return r.Priority
+	}
+	return RulePriority(r.Rule)
 }
@@ -1,6 +1,10 @@
 package engine
 
-import "net/http"
+import (
+	"maps"
+	"net/http"
+	"sync"
+)
 
 type HTTPRouter interface {
 	Match(req *http.Request) (string, *HTTPRoute)
@@ -8,23 +12,27 @@ type HTTPRouter interface {
 	DeregisterRoute(routeId string)
 	SetMiddleware(middleware Middleware) HTTPRouter
 	Middleware() Middleware
+	Routes() map[string]*HTTPRoute
 }
 
 type httpRouter struct {
+	mu         sync.RWMutex
 	routes     map[string]*HTTPRoute
 	middleware Middleware
 }
 
 func NewHTTPRouter() *httpRouter {
 	return &httpRouter{
-		make(map[string]*HTTPRoute),
-		nil,
+		routes: make(map[string]*HTTPRoute),
 	}
 }
 
 func (r *httpRouter) Match(req *http.Request) (string, *HTTPRoute) {
-	for id, route := range r.routes {
-		if route.Rule.Match(req) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, id := range orderRoutes(r.routes) {
+		if route := r.routes[id]; route.Rule.Match(req) {
 			return id, route
 		}
 	}
@@ -33,19 +41,33 @@ func (r *httpRouter) Match(req *http.Request) (string, *HTTPRoute) {
 }
 
 func (r *httpRouter) SetMiddleware(middleware Middleware) HTTPRouter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.middleware = middleware
 	return r
 }
 
 func (r *httpRouter) Middleware() Middleware {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.middleware
 }
 
 func (r *httpRouter) RegisterRoute(routeId string, route *HTTPRoute) HTTPRouter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.routes[routeId] = route
 	return r
 }
 
 func (r *httpRouter) DeregisterRoute(routeId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	delete(r.routes, routeId)
 }
+
+func (r *httpRouter) Routes() map[string]*HTTPRoute {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return maps.Clone(r.routes)
+}
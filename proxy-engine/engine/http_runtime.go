@@ -7,109 +7,138 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync"
 )
 
-type HTTPRuntime struct {
-	handlers map[string]http.Handler
-}
+type HTTPRuntime struct{}
 
 func NewHTTPRuntime() *HTTPRuntime {
-	return &HTTPRuntime{
-		handlers: make(map[string]http.Handler),
-	}
+	return &HTTPRuntime{}
 }
 
 type singleConnListener struct {
-	conn net.Conn
-	done bool
+	conn      net.Conn
+	accepted  bool
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-func (l *singleConnListener) Accept() (net.Conn, error) {
-	if l.done {
-		return nil, io.EOF
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{
+		conn:   conn,
+		closed: make(chan struct{}),
 	}
-	l.done = true
-	return l.conn, nil
 }
 
-func (l *singleConnListener) Close() error   { return nil }
-func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
-
-func (r *HTTPRuntime) HandleTLSConnection(ctx context.Context, e string, conn *tls.Conn) error {
-	handler, ok := r.handlers[e]
-	if !ok {
-		conn.Close()
-		return fmt.Errorf("No handlers registered for this entrypoint")
-	}
-	srv := &http.Server{
-		Handler:     handler,
-		BaseContext: func(net.Listener) context.Context { return ctx },
-	}
-	err := srv.Serve(&singleConnListener{conn: conn})
-	if err != io.EOF {
-		return err
+// Accept hands out the connection once, then blocks until the listener is
+// closed so that http.Server keeps serving the connection until it is done.
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
 	}
-	return nil
+	<-l.closed
+	return nil, io.EOF
 }
 
-func (r *HTTPRuntime) HandleRawConnection(ctx context.Context, e string, conn BufferedConn) error {
-	handler, ok := r.handlers[e]
-	if !ok {
-		return fmt.Errorf("No handlers registered for this entrypoint")
-	}
-	srv := &http.Server{
-		Handler:     handler,
-		BaseContext: func(net.Listener) context.Context { return ctx },
-	}
-	err := srv.Serve(&singleConnListener{conn: conn})
-	if err != io.EOF {
-		return err
-	}
+func (l *singleConnListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
 	return nil
 }
 
-func (r *HTTPRuntime) Claim(e string, conn BufferedConn) bool {
-	if _, ok := r.handlers[e]; !ok {
-		return false
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// serve blocks until the connection is closed. When ctx is cancelled the
+// in-flight request is allowed to finish before the connection is closed.
+func (r *HTTPRuntime) serve(ctx context.Context, handler http.Handler, conn net.Conn) error {
+	ln := newSingleConnListener(conn)
+
+	// http.Server only fills in r.TLS for a *tls.Conn, terminated
+	// connections reach it wrapped so the state is carried over here
+	var tlsState *tls.ConnectionState
+	if tcpConn, ok := conn.(*BufferedTCPConn); ok {
+		tlsState = tcpConn.TLS()
 	}
 
-	if ok, _ := CheckForClientHello(conn); ok {
-		return true
+	// TLS is already terminated by the time http.Server sees the stream, so
+	// h2 negotiated through ALPN is served as prior knowledge HTTP/2
+	protocols := new(http.Protocols)
+	switch {
+	case tlsState == nil:
+		// Cleartext connections may start with the HTTP/2 preface or ask
+		// to upgrade to it
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		handler = h2cUpgrade(handler)
+	case tlsState.NegotiatedProtocol == "h2":
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
 	}
 
-	data, err := conn.Peek(5)
-	if err != nil {
-		return false
+	var inflight sync.WaitGroup
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			inflight.Add(1)
+			defer inflight.Done()
+			if req.TLS == nil && tlsState != nil {
+				req.TLS = tlsState
+			}
+			handler.ServeHTTP(w, req)
+		}),
+		Protocols: protocols,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.WithoutCancel(ctx), proxyHeaderKey{}, ProxyHeaderOf(conn))
+		},
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				ln.Close()
+			}
+		},
 	}
 
-	s := string(data)
-
-	switch s {
-	case
-		"GET /",
-		"HEAD ",
-		"POST ",
-		"PUT /",
-		"DELET",
-		"CONNE",
-		"OPTIO",
-		"TRACE",
-		"PATCH":
-		return true
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case <-ln.closed:
+	case <-ctx.Done():
+		srv.Shutdown(context.Background())
 	}
 
-	return false
+	// Hijacked connections are still owned by their handler
+	inflight.Wait()
+
+	err := <-serveErr
+	if err != io.EOF && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
-func (r *HTTPRuntime) RegisterHandler(entryPointId string, handler http.Handler) {
-	r.handlers[entryPointId] = handler
+func (r *HTTPRuntime) HandleTLSConnection(ctx context.Context, handler http.Handler, conn *BufferedTCPConn) error {
+	if handler == nil {
+		conn.Close()
+		return fmt.Errorf("No handlers registered for this entrypoint")
+	}
+	return r.serve(ctx, handler, conn)
 }
 
-func (r *HTTPRuntime) DeregisterHandler(entryPointId string) {
-	delete(r.handlers, entryPointId)
+func (r *HTTPRuntime) HandleRawConnection(ctx context.Context, handler http.Handler, conn BufferedConn) error {
+	return r.serve(ctx, handler, conn)
 }
 
-func (r *HTTPRuntime) IsHandlerRegistered(entryPointId string) bool {
-	_, present := r.handlers[entryPointId]
-	return present
+// Claim takes raw connections sniffed as HTTP/1 or prior knowledge h2c
+// when the entrypoint has an HTTP handler.
+func (r *HTTPRuntime) Claim(handler http.Handler, conn BufferedConn) bool {
+	if handler == nil {
+		return false
+	}
+
+	return conn.Protocol() == SniffHTTP1 || conn.Protocol() == SniffH2C
 }
@@ -0,0 +1,150 @@
+package engine
+
+import "fmt"
+
+// The request line has to fit in the connection's read buffer, which is
+// bufio's default size
+const httpSniffMaxRequestLine = 4096
+
+// HTTPSniffResult is the request line a raw connection opened with.
+type HTTPSniffResult struct {
+	Method  string
+	Target  string
+	Version string
+}
+
+func (r HTTPSniffResult) String() string {
+	return fmt.Sprintf("%s %s %s", r.Method, r.Target, r.Version)
+}
+
+// SniffHTTPRequestLine peeks at the request line of a raw connection
+// without consuming it (RFC 9112 section 3). Any token is accepted as the
+// method, so WebDAV and other extension methods are recognised, as is the
+// HTTP/2 connection preface. Bytes are peeked only until the line is known
+// not to be HTTP, the line is longer than the limit or the read deadline
+// set on conn passes.
+func SniffHTTPRequestLine(conn BufferedConn) (HTTPSniffResult, error) {
+	var result HTTPSniffResult
+
+	err := peekGrowing(conn.Reader(), httpSniffMaxRequestLine, func(data []byte) (bool, error) {
+		var complete bool
+		var err error
+		result, complete, err = parseRequestLine(data)
+		return complete, err
+	})
+	if err != nil {
+		return HTTPSniffResult{}, err
+	}
+
+	return result, nil
+}
+
+// parseRequestLine validates as much of a request line as data holds. It
+// errors as soon as data can no longer be the start of one.
+func parseRequestLine(data []byte) (HTTPSniffResult, bool, error) {
+	method, rest, ok, err := cutToken(data, isTokenChar, "method")
+	if !ok {
+		return HTTPSniffResult{}, false, err
+	}
+	if len(method) == 0 {
+		return HTTPSniffResult{}, false, fmt.Errorf("Empty method")
+	}
+
+	target, rest, ok, err := cutToken(rest, isTargetChar, "request target")
+	if !ok {
+		return HTTPSniffResult{}, false, err
+	}
+	if len(target) == 0 {
+		return HTTPSniffResult{}, false, fmt.Errorf("Empty request target")
+	}
+
+	line, ok := cutLine(rest)
+	if !ok {
+		if len(rest) > len("HTTP/x.y\r") {
+			return HTTPSniffResult{}, false, fmt.Errorf("Invalid HTTP version")
+		}
+		if !isVersionPrefix(rest) {
+			return HTTPSniffResult{}, false, fmt.Errorf("Invalid HTTP version %q", rest)
+		}
+		return HTTPSniffResult{}, false, nil
+	}
+
+	version := string(line)
+	switch {
+	case version == "HTTP/1.0", version == "HTTP/1.1":
+	case version == "HTTP/2.0" && string(method) == "PRI" && string(target) == "*":
+	default:
+		return HTTPSniffResult{}, false, fmt.Errorf("Unsupported HTTP version %q", version)
+	}
+
+	return HTTPSniffResult{
+		Method:  string(method),
+		Target:  string(target),
+		Version: version,
+	}, true, nil
+}
+
+// cutToken splits data at the first space. complete is false while there
+// is no space yet and every byte so far is valid.
+func cutToken(data []byte, valid func(byte) bool, part string) (token []byte, rest []byte, complete bool, err error) {
+	for i, c := range data {
+		if c == ' ' {
+			return data[:i], data[i+1:], true, nil
+		}
+		if !valid(c) {
+			return nil, nil, false, fmt.Errorf("Invalid character %q in %s", c, part)
+		}
+	}
+	return nil, nil, false, nil
+}
+
+// cutLine returns the line up to CRLF, or a bare LF which recipients may
+// accept as a line terminator.
+func cutLine(data []byte) ([]byte, bool) {
+	for i, c := range data {
+		if c != '\n' {
+			continue
+		}
+		if i > 0 && data[i-1] == '\r' {
+			return data[:i-1], true
+		}
+		return data[:i], true
+	}
+	return nil, false
+}
+
+func isVersionPrefix(data []byte) bool {
+	const pattern = "HTTP/d.d\r"
+	for i, c := range data {
+		switch p := pattern[i]; p {
+		case 'd':
+			if c < '0' || c > '9' {
+				return false
+			}
+		default:
+			if c != p {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isTokenChar reports whether c is a tchar (RFC 9110 section 5.6.2).
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	switch c {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return false
+}
+
+// Request targets are visible ASCII in every form, absolute-form proxy
+// requests and CONNECT authorities included.
+func isTargetChar(c byte) bool {
+	return c > ' ' && c < 0x7f
+}
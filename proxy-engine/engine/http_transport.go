@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultHTTPTransportMaxIdleConns        = 100
+	DefaultHTTPTransportMaxIdleConnsPerHost = 32
+	DefaultHTTPTransportIdleConnTimeout     = 90 * time.Second
+	DefaultHTTPTransportDialTimeout         = 30 * time.Second
+	DefaultHTTPTransportKeepAlive           = 30 * time.Second
+)
+
+// HTTPTransportConfig tunes the connections a reverse proxy keeps to its
+// upstream. Zero values take the defaults.
+type HTTPTransportConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	// Interval of TCP keep-alive probes, negative turns them off
+	KeepAlive time.Duration
+	// How long to wait for the upstream's response headers once the
+	// request is sent, no limit when zero
+	ResponseHeaderTimeout time.Duration
+	// Speaks HTTP/2 with prior knowledge to cleartext upstreams, which
+	// must support it. Upstreams behind TLS negotiate it regardless.
+	HTTP2 bool
+}
+
+// newHTTPTransport returns the transport a reverse proxy uses for every
+// request to upstream. With a PROXY protocol header each connection
+// belongs to a single client, so they are not kept alive for reuse.
+func newHTTPTransport(upstream *url.URL, config HTTPTransportConfig, tlsConfig *tls.Config, proxyProtocol bool) *http.Transport {
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = DefaultHTTPTransportMaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost <= 0 {
+		config.MaxIdleConnsPerHost = DefaultHTTPTransportMaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout <= 0 {
+		config.IdleConnTimeout = DefaultHTTPTransportIdleConnTimeout
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = DefaultHTTPTransportDialTimeout
+	}
+	if config.KeepAlive == 0 {
+		config.KeepAlive = DefaultHTTPTransportKeepAlive
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	transport.DialContext = dialer.DialContext
+
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+
+	if config.HTTP2 && upstream.Scheme == "http" {
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = protocols
+	}
+
+	if proxyProtocol {
+		transport.DisableKeepAlives = true
+		transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+
+			if header, ok := ctx.Value(upstreamProxyHeaderKey{}).(*ProxyHeader); ok {
+				if _, err := header.WriteTo(conn); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+
+			return conn, nil
+		}
+	}
+
+	return transport
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+// newCountingUpstream starts an upstream that counts the connections
+// dialed to it.
+func newCountingUpstream(tb testing.TB) (*httptest.Server, *atomic.Int64) {
+	tb.Helper()
+
+	var dials atomic.Int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	upstream.Start()
+	tb.Cleanup(upstream.Close)
+
+	return upstream, &dials
+}
+
+func TestHTTPReverseProxyReusesConnections(t *testing.T) {
+	upstream, dials := newCountingUpstream(t)
+
+	proxy, err := NewHTTPReverseProxy(upstream.URL, HTTPReverseProxyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 20 {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+
+	if n := dials.Load(); n != 1 {
+		t.Errorf("20 sequential requests dialed the upstream %d times, want 1", n)
+	}
+}
+
+// BenchmarkHTTPReverseProxy compares the pooled transport every proxy is
+// built with against building a proxy and transport for each request.
+func BenchmarkHTTPReverseProxy(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		upstream, dials := newCountingUpstream(b)
+
+		proxy, err := NewHTTPReverseProxy(upstream.URL, HTTPReverseProxyConfig{})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		benchmarkProxy(b, dials, func() http.Handler { return proxy })
+	})
+
+	b.Run("per-request", func(b *testing.B) {
+		upstream, dials := newCountingUpstream(b)
+		target, _ := url.Parse(upstream.URL)
+
+		benchmarkProxy(b, dials, func() http.Handler {
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			transport := newHTTPTransport(target, HTTPTransportConfig{}, nil, false)
+			proxy.Transport = transport
+
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxy.ServeHTTP(w, r)
+				// The transport is dropped after the request, close its
+				// connection rather than leak it
+				transport.CloseIdleConnections()
+			})
+		})
+	})
+}
+
+func benchmarkProxy(b *testing.B, dials *atomic.Int64, proxy func() http.Handler) {
+	b.ReportAllocs()
+	dials.Store(0)
+
+	for b.Loop() {
+		w := httptest.NewRecorder()
+		proxy().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy/", nil))
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d", w.Code)
+		}
+	}
+
+	b.ReportMetric(float64(dials.Load())/float64(b.N), "dials/op")
+}
@@ -1,9 +1,11 @@
 package engine
 
 import (
+	"encoding/pem"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -78,3 +80,41 @@ func SetForwardingHeaders() Middleware {
 		next.ServeHTTP(w, r)
 	})
 }
+
+const ForwardedClientCertHeader = "X-Forwarded-Client-Cert"
+
+// ForwardClientCert passes the verified client certificate of the TLS
+// connection to upstreams in the X-Forwarded-Client-Cert header, in the
+// same format as Envoy. Any value sent by the client itself is dropped,
+// and nothing is forwarded for a certificate that was not verified.
+func ForwardClientCert() Middleware {
+	return MiddlewareFunc(func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+		r.Header.Del(ForwardedClientCertHeader)
+
+		if cert := verifiedClientCert(r.TLS); cert != nil {
+
+			fields := []string{
+				"Hash=" + CertFingerprint(cert),
+				"Cert=" + quoteClientCertValue(url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{
+					Type:  "CERTIFICATE",
+					Bytes: cert.Raw,
+				})))),
+				"Subject=" + quoteClientCertValue(cert.Subject.String()),
+			}
+			for _, uri := range cert.URIs {
+				fields = append(fields, "URI="+uri.String())
+			}
+			for _, name := range cert.DNSNames {
+				fields = append(fields, "DNS="+name)
+			}
+
+			r.Header.Set(ForwardedClientCertHeader, strings.Join(fields, ";"))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func quoteClientCertValue(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
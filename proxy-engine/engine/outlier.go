@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOutlierConsecutiveFailures = 5
+	DefaultOutlierMinimumRequests     = 10
+	DefaultOutlierInterval            = 10 * time.Second
+	DefaultOutlierBaseEjectionTime    = 30 * time.Second
+	DefaultOutlierMaxEjectionTime     = 5 * time.Minute
+	DefaultOutlierMaxEjectionPercent  = 50
+)
+
+// OutlierDetection ejects members of a load balancer that fail real
+// traffic, HTTP requests answered with a 5xx and TCP connections whose
+// backend could not be dialed. Each ejection of the same member lasts
+// twice as long as the one before, up to MaxEjectionTime.
+type OutlierDetection struct {
+	// Failures in a row that eject a member
+	ConsecutiveFailures int
+	// Share of requests within Interval that have to fail to eject a
+	// member, 0 turns the check off
+	FailurePercent int
+	// Requests a member needs within Interval before FailurePercent applies
+	MinimumRequests int
+	Interval        time.Duration
+	// How long the first ejection lasts
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	// Cap on the members ejected at once, so an outage of every backend
+	// does not empty the pool. Rounded down, so a single member pool is
+	// never ejected from.
+	MaxEjectionPercent int
+}
+
+type outlierDetector struct {
+	config OutlierDetection
+
+	mu       sync.Mutex
+	backends map[*Backend]*outlierState
+}
+
+type outlierState struct {
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	ejections   int
+}
+
+func newOutlierDetector(config OutlierDetection, backends []*Backend) *outlierDetector {
+	if config.ConsecutiveFailures <= 0 {
+		config.ConsecutiveFailures = DefaultOutlierConsecutiveFailures
+	}
+	if config.MinimumRequests <= 0 {
+		config.MinimumRequests = DefaultOutlierMinimumRequests
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultOutlierInterval
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = DefaultOutlierBaseEjectionTime
+	}
+	if config.MaxEjectionTime <= 0 {
+		config.MaxEjectionTime = DefaultOutlierMaxEjectionTime
+	}
+	if config.MaxEjectionPercent <= 0 {
+		config.MaxEjectionPercent = DefaultOutlierMaxEjectionPercent
+	}
+
+	d := &outlierDetector{
+		config:   config,
+		backends: make(map[*Backend]*outlierState),
+	}
+	for _, b := range backends {
+		d.backends[b] = &outlierState{}
+	}
+
+	return d
+}
+
+// record counts the outcome of a request and ejects b once it crosses
+// either threshold.
+func (d *outlierDetector) record(b *Backend, failed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	state := d.backends[b]
+
+	// Requests that were in flight when b was ejected say nothing new
+	ejectedUntil := b.ejectedUntilTime()
+	if now.Before(ejectedUntil) {
+		return
+	}
+
+	// A member that stayed in for as long as the longest ejection starts
+	// over from the base ejection time
+	if state.ejections > 0 && now.Sub(ejectedUntil) >= d.config.MaxEjectionTime {
+		state.ejections = 0
+	}
+
+	if now.Sub(state.windowStart) >= d.config.Interval {
+		state.windowStart = now
+		state.requests = 0
+		state.failures = 0
+	}
+
+	state.requests++
+	if failed {
+		state.failures++
+		state.consecutive++
+	} else {
+		state.consecutive = 0
+	}
+
+	var reason string
+	switch {
+	case state.consecutive >= d.config.ConsecutiveFailures:
+		reason = "consecutive failures"
+	case d.config.FailurePercent > 0 &&
+		state.requests >= d.config.MinimumRequests &&
+		state.failures*100 >= state.requests*d.config.FailurePercent:
+		reason = "failure rate"
+	default:
+		return
+	}
+
+	if !d.canEject(now) {
+		log.Printf("%s | Not ejecting backend for %s, too many are ejected already\n", b.name, reason)
+		state.consecutive = 0
+		state.windowStart = time.Time{}
+		return
+	}
+
+	duration := d.config.BaseEjectionTime << min(state.ejections, 30)
+	duration = min(duration, d.config.MaxEjectionTime)
+	if duration <= 0 {
+		duration = d.config.MaxEjectionTime
+	}
+
+	log.Printf(
+		"%s | Ejecting backend for %s on %s, %d of %d requests failed\n",
+		b.name, duration, reason, state.failures, state.requests,
+	)
+
+	state.ejections++
+	state.consecutive = 0
+	state.windowStart = time.Time{}
+	b.ejectedUntil.Store(now.Add(duration).UnixNano())
+}
+
+func (d *outlierDetector) canEject(now time.Time) bool {
+	ejected := 0
+	for b := range d.backends {
+		if now.Before(b.ejectedUntilTime()) {
+			ejected++
+		}
+	}
+	return (ejected+1)*100 <= len(d.backends)*d.config.MaxEjectionPercent
+}
+
+// statusRecorder keeps the status a handler answered with. Unwrap lets
+// http.ResponseController reach the flushing and hijacking the reverse
+// proxy relies on.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,553 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// PROXY protocol v2 TLV types
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVCRC32C    byte = 0x03
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	ProxyTLVNetNS     byte = 0x30
+	ProxyTLVAWS       byte = 0xEA
+	ProxyTLVAzure     byte = 0xEE
+)
+
+const (
+	proxyV1MaxLength     = 107
+	proxyV2HeaderLength  = 16
+	proxyAWSVPCEndpoint  = 0x01
+	proxyV2CommandLocal  = 0x0
+	proxyV2CommandProxy  = 0x1
+	proxyV2FamilyInet    = 0x1
+	proxyV2FamilyInet6   = 0x2
+	proxyV2FamilyUnix    = 0x3
+	proxyV2TransportTCP  = 0x1
+	proxyV2AddressInet   = 12
+	proxyV2AddressInet6  = 36
+	proxyV2AddressUnix   = 216
+	proxyV2VersionNibble = 0x2
+)
+
+type ProxyProtocolConfig struct {
+	// Peers allowed to send a header, which they then must send. Headers
+	// from anyone else are left in the stream.
+	Trusted []netip.Prefix
+	// How long a trusted peer has to send the header, defaults to
+	// DefaultProxyHeaderTimeout
+	Timeout time.Duration
+}
+
+func (c ProxyProtocolConfig) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range c.Trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyTLV is a type-length-value field of a v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a PROXY protocol header sent by a load balancer in front
+// of the proxy.
+type ProxyHeader struct {
+	Version int
+	// False for connections the load balancer opened on its own behalf,
+	// such as health checks, which carry no client addresses
+	Proxied     bool
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []ProxyTLV
+}
+
+// TLV returns the value of the first TLV of the type.
+func (h *ProxyHeader) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Authority is the host name the client asked for, usually the TLS SNI
+// the load balancer saw.
+func (h *ProxyHeader) Authority() string {
+	value, _ := h.TLV(ProxyTLVAuthority)
+	return string(value)
+}
+
+// AWSVPCEndpointID is the ID of the VPC endpoint an AWS Network Load
+// Balancer received the connection through.
+func (h *ProxyHeader) AWSVPCEndpointID() string {
+	value, ok := h.TLV(ProxyTLVAWS)
+	if !ok || len(value) == 0 || value[0] != proxyAWSVPCEndpoint {
+		return ""
+	}
+	return string(value[1:])
+}
+
+// ProxyHeaderOf returns the PROXY protocol header a connection was
+// accepted with, looking through any wrapping connections. It is nil when
+// the connection did not come through a trusted load balancer.
+func ProxyHeaderOf(conn net.Conn) *ProxyHeader {
+	for conn != nil {
+		if c, ok := conn.(*proxyProtocolConn); ok {
+			header, _ := c.readHeader()
+			return header
+		}
+
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
+
+type proxyHeaderKey struct{}
+
+// proxyHeaderFromContext returns the header of the connection an HTTP
+// request arrived on.
+func proxyHeaderFromContext(ctx context.Context) *ProxyHeader {
+	header, _ := ctx.Value(proxyHeaderKey{}).(*ProxyHeader)
+	return header
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	config ProxyProtocolConfig
+}
+
+func newProxyProtocolListener(ln net.Listener, config ProxyProtocolConfig) net.Listener {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultProxyHeaderTimeout
+	}
+
+	return &proxyProtocolListener{
+		Listener: ln,
+		config:   config,
+	}
+}
+
+// Accept does not wait for the header, it is read by the connection's own
+// goroutine the first time it is needed.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.config.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.config.Timeout,
+	}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+
+	// The caller's read deadline, restored once the header is read
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyProtocolConn) readHeader() (*ProxyHeader, error) {
+	c.once.Do(func() {
+		c.deadlineMu.Lock()
+		callerDeadline := c.readDeadline
+		c.deadlineMu.Unlock()
+
+		deadline := time.Now().Add(c.timeout)
+		if !callerDeadline.IsZero() && callerDeadline.Before(deadline) {
+			deadline = callerDeadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+		defer func() {
+			c.deadlineMu.Lock()
+			defer c.deadlineMu.Unlock()
+			c.Conn.SetReadDeadline(c.readDeadline)
+		}()
+
+		c.header, c.err = parseProxyHeader(c.reader)
+		if c.err != nil {
+			// Not wrapped, a timeout reading the header must not look
+			// like a timeout of the stream that follows it
+			c.err = fmt.Errorf("Invalid PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+	return c.header, c.err
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	if _, err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	header, err := c.readHeader()
+	if err != nil || !header.Proxied || header.Source == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return header.Source
+}
+
+func (c *proxyProtocolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func parseProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	signature, err := r.Peek(len(proxyV1Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if string(signature) == proxyV1Signature {
+		return parseProxyV1(r)
+	}
+
+	signature, err = r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if string(signature) == proxyV2Signature {
+		return parseProxyV2(r)
+	}
+
+	return nil, fmt.Errorf("Missing header")
+}
+
+// parseProxyV1 parses the text header, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func parseProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	err := peekGrowing(r, proxyV1MaxLength, func(data []byte) (bool, error) {
+		i := bytes.Index(data, []byte("\r\n"))
+		if i == -1 {
+			return false, nil
+		}
+		line = data[:i]
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	text := string(line)
+	r.Discard(len(line) + 2)
+
+	fields := strings.Split(text, " ")
+
+	header := &ProxyHeader{Version: 1}
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Malformed v1 header %q", text)
+	}
+
+	source, err := parseProxyV1Addr(fields[2], fields[4], fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	destination, err := parseProxyV1Addr(fields[3], fields[5], fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	header.Proxied = true
+	header.Source = source
+	header.Destination = destination
+
+	return header, nil
+}
+
+func parseProxyV1Addr(host string, port string, family string) (net.Addr, error) {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid v1 address %q", host)
+	}
+	if ip.Is4() != (family == "TCP4") {
+		return nil, fmt.Errorf("v1 address %q is not %s", host, family)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid v1 port %q", port)
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(p))), nil
+}
+
+// parseProxyV2 parses the binary header.
+func parseProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	version, command := fixed[12]>>4, fixed[12]&0x0F
+	family, transport := fixed[13]>>4, fixed[13]&0x0F
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+
+	if version != proxyV2VersionNibble {
+		return nil, fmt.Errorf("Unknown v2 version %d", version)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2}
+
+	switch command {
+	case proxyV2CommandLocal:
+		return header, nil
+	case proxyV2CommandProxy:
+	default:
+		return nil, fmt.Errorf("Unknown v2 command %d", command)
+	}
+
+	var addressLength int
+	switch family {
+	case proxyV2FamilyInet:
+		addressLength = proxyV2AddressInet
+	case proxyV2FamilyInet6:
+		addressLength = proxyV2AddressInet6
+	case proxyV2FamilyUnix:
+		addressLength = proxyV2AddressUnix
+	}
+
+	if len(payload) < addressLength {
+		return nil, fmt.Errorf("v2 address block too short")
+	}
+
+	// Only TCP over IP is proxied, anything else keeps the balancer's
+	// addresses
+	if transport == proxyV2TransportTCP && (family == proxyV2FamilyInet || family == proxyV2FamilyInet6) {
+		ipLength := (addressLength - 4) / 2
+		source, _ := netip.AddrFromSlice(payload[:ipLength])
+		destination, _ := netip.AddrFromSlice(payload[ipLength : 2*ipLength])
+		sourcePort := binary.BigEndian.Uint16(payload[2*ipLength:])
+		destinationPort := binary.BigEndian.Uint16(payload[2*ipLength+2:])
+
+		header.Proxied = true
+		header.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(source.Unmap(), sourcePort))
+		header.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(destination.Unmap(), destinationPort))
+	}
+
+	tlvs, err := parseProxyTLVs(payload[addressLength:])
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+
+	return header, nil
+}
+
+func parseProxyTLVs(data []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("Truncated v2 TLV")
+		}
+
+		t := data[0]
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, fmt.Errorf("Truncated v2 TLV of type 0x%02x", t)
+		}
+
+		tlvs = append(tlvs, ProxyTLV{Type: t, Value: data[3 : 3+length]})
+		data = data[3+length:]
+	}
+	return tlvs, nil
+}
+
+// WriteTo writes the header in its version's encoding. Addresses that are
+// not TCP are sent as unknown, v1 also needs both to be the same family.
+func (h *ProxyHeader) WriteTo(w io.Writer) (int64, error) {
+	var data []byte
+	if h.Version == 1 {
+		data = h.appendV1(nil)
+	} else {
+		data = h.appendV2(nil)
+	}
+
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+func (h *ProxyHeader) addrPorts() (netip.AddrPort, netip.AddrPort, bool) {
+	source, ok := h.Source.(*net.TCPAddr)
+	if !h.Proxied || !ok {
+		return netip.AddrPort{}, netip.AddrPort{}, false
+	}
+	destination, ok := h.Destination.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, netip.AddrPort{}, false
+	}
+
+	src, dst := source.AddrPort(), destination.AddrPort()
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+
+	return src, dst, src.Addr().IsValid() && dst.Addr().IsValid()
+}
+
+func (h *ProxyHeader) appendV1(data []byte) []byte {
+	src, dst, ok := h.addrPorts()
+	if !ok || src.Addr().Is4() != dst.Addr().Is4() {
+		return append(data, "PROXY UNKNOWN\r\n"...)
+	}
+
+	family := "TCP4"
+	if !src.Addr().Is4() {
+		family = "TCP6"
+	}
+
+	return fmt.Appendf(data, "PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+}
+
+func (h *ProxyHeader) appendV2(data []byte) []byte {
+	data = append(data, proxyV2Signature...)
+
+	src, dst, ok := h.addrPorts()
+
+	command := byte(proxyV2CommandProxy)
+	if !h.Proxied {
+		command = proxyV2CommandLocal
+	}
+	data = append(data, proxyV2VersionNibble<<4|command)
+
+	var addresses []byte
+	switch {
+	case !ok:
+		data = append(data, 0)
+	case src.Addr().Is4() && dst.Addr().Is4():
+		data = append(data, proxyV2FamilyInet<<4|proxyV2TransportTCP)
+		addresses = append(addresses, src.Addr().AsSlice()...)
+		addresses = append(addresses, dst.Addr().AsSlice()...)
+	default:
+		// Mixed families are both sent as IPv6
+		data = append(data, proxyV2FamilyInet6<<4|proxyV2TransportTCP)
+		src16, dst16 := src.Addr().As16(), dst.Addr().As16()
+		addresses = append(addresses, src16[:]...)
+		addresses = append(addresses, dst16[:]...)
+	}
+	if ok {
+		addresses = binary.BigEndian.AppendUint16(addresses, src.Port())
+		addresses = binary.BigEndian.AppendUint16(addresses, dst.Port())
+	}
+
+	for _, tlv := range h.TLVs {
+		addresses = append(addresses, tlv.Type)
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(len(tlv.Value)))
+		addresses = append(addresses, tlv.Value...)
+	}
+
+	data = binary.BigEndian.AppendUint16(data, uint16(len(addresses)))
+	return append(data, addresses...)
+}
+
+// UpstreamProxyProtocol has reverse proxies open every upstream connection
+// with a PROXY protocol header naming the client, so backends such as
+// Paper or Velocity see the real client address.
+type UpstreamProxyProtocol struct {
+	// 1 or 2
+	Version int
+	// TLVs to add to v2 headers, ProxyTLVAuthority for the SNI the client
+	// sent and ProxyTLVALPN for the protocol negotiated with it
+	TLVs []byte
+}
+
+func (p *UpstreamProxyProtocol) header(source net.Addr, destination net.Addr, sni string, alpn string) *ProxyHeader {
+	header := &ProxyHeader{
+		Version:     p.Version,
+		Proxied:     true,
+		Source:      source,
+		Destination: destination,
+	}
+
+	if p.Version != 2 {
+		return header
+	}
+
+	for _, t := range p.TLVs {
+		switch {
+		case t == ProxyTLVAuthority && sni != "":
+			header.TLVs = append(header.TLVs, ProxyTLV{Type: t, Value: []byte(sni)})
+		case t == ProxyTLVALPN && alpn != "":
+			header.TLVs = append(header.TLVs, ProxyTLV{Type: t, Value: []byte(alpn)})
+		}
+	}
+
+	return header
+}
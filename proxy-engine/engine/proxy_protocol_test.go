@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// TestProxyProtocolKeepsSniffDeadline has a trusted peer send its header
+// and then go idle, the sniff must still give up at its own timeout.
+func TestProxyProtocolKeepsSniffDeadline(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener = newProxyProtocolListener(listener, ProxyProtocolConfig{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+	})
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	registry := NewSnifferRegistry(100*time.Millisecond, DefaultSniffers()...)
+
+	result := make(chan string, 1)
+	go func() {
+		protocol, err := registry.Sniff(NewBufferedConn(conn))
+		if err != nil {
+			t.Error(err)
+		}
+		result <- protocol
+	}()
+
+	select {
+	case protocol := <-result:
+		if protocol != "" {
+			t.Errorf("sniffed %q from an idle connection", protocol)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("sniffing an idle connection behind a PROXY header never timed out")
+	}
+
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("remote address %s, want the one from the header", got)
+	}
+}
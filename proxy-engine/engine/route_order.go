@@ -0,0 +1,29 @@
+package engine
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strings"
+)
+
+type prioritizedRoute interface {
+	priority() int
+}
+
+func compareRoutes(aId string, a prioritizedRoute, bId string, b prioritizedRoute) int {
+	if c := cmp.Compare(b.priority(), a.priority()); c != 0 {
+		return c
+	}
+	return strings.Compare(aId, bId)
+}
+
+// orderRoutes returns route ids in the order they should be matched,
+// highest priority first and ties broken by route id.
+func orderRoutes[R prioritizedRoute](routes map[string]R) []string {
+	ids := slices.Collect(maps.Keys(routes))
+	slices.SortFunc(ids, func(a, b string) int {
+		return compareRoutes(a, routes[a], b, routes[b])
+	})
+	return ids
+}
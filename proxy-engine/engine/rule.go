@@ -2,6 +2,7 @@ package engine
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"regexp"
@@ -39,81 +40,228 @@ func (r TCPRuleFunc) Match(v any) bool {
 	return r(ctx)
 }
 
-func Host(host string) HTTPRuleFunc {
-	return func(r *http.Request) bool {
-		return r.Host == host
+// exprRule remembers the expression a rule was built from. The length of
+// the expression is used as the default route priority, so longer and
+// more specific rules are tried first.
+type exprRule struct {
+	Rule
+	expr string
+}
+
+func (r exprRule) String() string {
+	return r.expr
+}
+
+// exprEscaper escapes the characters lexRule unescapes in single quoted
+// strings.
+var exprEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func withExpr(rule Rule, name string, args ...string) Rule {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + exprEscaper.Replace(arg) + "'"
+	}
+	return exprRule{
+		Rule: rule,
+		expr: name + "(" + strings.Join(quoted, ", ") + ")",
 	}
 }
 
-func PathPrefix(prefix string) HTTPRuleFunc {
-	return func(r *http.Request) bool {
-		return strings.HasPrefix(r.URL.Path, prefix)
+func joinExpr(rules []Rule, op string) string {
+	exprs := make([]string, len(rules))
+	for i, r := range rules {
+		exprs[i] = RuleString(r)
 	}
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return "(" + strings.Join(exprs, " "+op+" ") + ")"
+}
+
+// RuleString returns the expression a rule was built from, or an empty
+// string for rules built directly from a func.
+func RuleString(rule Rule) string {
+	if s, ok := rule.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return ""
 }
 
-func PathRegexp(pattern string) HTTPRuleFunc {
+func RulePriority(rule Rule) int {
+	return len(RuleString(rule))
+}
+
+func Host(host string) Rule {
+	return withExpr(HTTPRuleFunc(func(r *http.Request) bool {
+		return r.Host == host
+	}), "Host", host)
+}
+
+func PathPrefix(prefix string) Rule {
+	return withExpr(HTTPRuleFunc(func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}), "PathPrefix", prefix)
+}
+
+func PathRegexp(pattern string) Rule {
 	re, err := regexp.Compile(pattern)
 	if err != nil {
-		return func(r *http.Request) bool {
+		return withExpr(HTTPRuleFunc(func(r *http.Request) bool {
 			return false
-		}
+		}), "PathRegexp", pattern)
 	}
 
-	return func(r *http.Request) bool {
+	return withExpr(HTTPRuleFunc(func(r *http.Request) bool {
 		return re.MatchString(r.URL.Path)
-	}
+	}), "PathRegexp", pattern)
 }
 
-func Path(path string) HTTPRuleFunc {
-	return func(r *http.Request) bool {
+func Path(path string) Rule {
+	return withExpr(HTTPRuleFunc(func(r *http.Request) bool {
 		return r.URL.Path == path
-	}
+	}), "Path", path)
 }
 
-func And(rules ...Rule) RuleFunc {
-	return RuleFunc(func(v any) bool {
-		for _, r := range rules {
-			if !r.Match(v) {
-				return false
+func And(rules ...Rule) Rule {
+	return exprRule{
+		Rule: RuleFunc(func(v any) bool {
+			for _, r := range rules {
+				if !r.Match(v) {
+					return false
+				}
 			}
-		}
-		return true
-	})
+			return true
+		}),
+		expr: joinExpr(rules, "AND"),
+	}
 }
 
-func Or(rules ...Rule) RuleFunc {
-	return RuleFunc(func(v any) bool {
-		for _, r := range rules {
-			if r.Match(v) {
-				return true
+func Or(rules ...Rule) Rule {
+	return exprRule{
+		Rule: RuleFunc(func(v any) bool {
+			for _, r := range rules {
+				if r.Match(v) {
+					return true
+				}
 			}
-		}
-		return false
-	})
+			return false
+		}),
+		expr: joinExpr(rules, "OR"),
+	}
 }
 
-func Not(r Rule) RuleFunc {
-	return RuleFunc(func(v any) bool {
-		return !r.Match(v)
-	})
+func Not(r Rule) Rule {
+	return exprRule{
+		Rule: RuleFunc(func(v any) bool {
+			return !r.Match(v)
+		}),
+		expr: "NOT " + RuleString(r),
+	}
 }
 
 func Any() Rule {
-	return RuleFunc(func(_ any) bool {
+	return withExpr(RuleFunc(func(_ any) bool {
 		return true
-	})
+	}), "Any")
 }
 
-func Method(method string) HTTPRuleFunc {
-	return func(r *http.Request) bool {
+func Method(method string) Rule {
+	return withExpr(HTTPRuleFunc(func(r *http.Request) bool {
 		return r.Method == method
-	}
+	}), "Method", method)
 }
 
-func HostSNI(sni string) TCPRuleFunc {
-	return func(t *TCPContext) bool {
+func HostSNI(sni string) Rule {
+	return withExpr(TCPRuleFunc(func(t *TCPContext) bool {
 		return t.ProtoType == "TLS" && t.SNI == sni
+	}), "HostSNI", sni)
+}
+
+// SniffedProtocol matches the protocol a sniffer labelled the connection
+// with, e.g. "ssh". Connections the proxy terminated TLS for stay "tls".
+func SniffedProtocol(protocols ...string) Rule {
+	return withExpr(TCPRuleFunc(func(t *TCPContext) bool {
+		return slices.Contains(protocols, t.Protocol)
+	}), "Protocol", protocols...)
+}
+
+// ALPN matches application protocols. On TCP it matches any protocol the
+// client offers, or only the negotiated one once the proxy has terminated
+// TLS with one. On HTTP it matches the protocol negotiated for the
+// request's connection.
+func ALPN(protocols ...string) Rule {
+	return withExpr(RuleFunc(func(v any) bool {
+		switch v := v.(type) {
+		case *TCPContext:
+			return slices.ContainsFunc(v.ALPN, func(p string) bool {
+				return slices.Contains(protocols, p)
+			})
+		case *http.Request:
+			return v.TLS != nil && slices.Contains(protocols, v.TLS.NegotiatedProtocol)
+		}
+		return false
+	}), "ALPN", protocols...)
+}
+
+// ProxyAuthority matches the authority TLV of the connection's PROXY
+// protocol header, which load balancers set to the SNI they saw.
+func ProxyAuthority(authorities ...string) Rule {
+	return withExpr(RuleFunc(func(v any) bool {
+		header := proxyHeaderOfMatch(v)
+		return header != nil && slices.Contains(authorities, header.Authority())
+	}), "ProxyAuthority", authorities...)
+}
+
+// ProxyVPCEndpoint matches the AWS VPC endpoint ID of the connection's
+// PROXY protocol header.
+func ProxyVPCEndpoint(ids ...string) Rule {
+	return withExpr(RuleFunc(func(v any) bool {
+		header := proxyHeaderOfMatch(v)
+		return header != nil && slices.Contains(ids, header.AWSVPCEndpointID())
+	}), "ProxyVPCEndpoint", ids...)
+}
+
+func proxyHeaderOfMatch(v any) *ProxyHeader {
+	switch v := v.(type) {
+	case *TCPContext:
+		return v.Proxy
+	case *http.Request:
+		return proxyHeaderFromContext(v.Context())
+	}
+	return nil
+}
+
+// ClientCertSubject matches connections whose TLS the proxy terminated
+// with a verified client certificate carrying one of the subjects, given either as
+// a full distinguished name or as the common name.
+func ClientCertSubject(subjects ...string) Rule {
+	return withExpr(TCPRuleFunc(func(t *TCPContext) bool {
+		cert := t.ClientCert()
+		if cert == nil {
+			return false
+		}
+
+		return slices.Contains(subjects, cert.Subject.String()) ||
+			slices.Contains(subjects, cert.Subject.CommonName)
+	}), "ClientCertSubject", subjects...)
+}
+
+// ClientCertFingerprint matches verified client certificates by their
+// SHA-256 fingerprint, written in hex with or without colons.
+func ClientCertFingerprint(fingerprints ...string) Rule {
+	normalized := make([]string, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		normalized[i] = strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
 	}
+
+	return withExpr(TCPRuleFunc(func(t *TCPContext) bool {
+		cert := t.ClientCert()
+		if cert == nil {
+			return false
+		}
+
+		return slices.Contains(normalized, CertFingerprint(cert))
+	}), "ClientCertFingerprint", fingerprints...)
 }
 
 func decodeVarInt(data []byte) (value int, length int, err error) {
@@ -275,19 +423,19 @@ func extractMinecraftData(t *TCPContext) (minecraftHandshakeData, error) {
 	return result, nil
 }
 
-func HostMinecraft(hosts ...string) TCPRuleFunc {
-	return func(t *TCPContext) bool {
+func HostMinecraft(hosts ...string) Rule {
+	return withExpr(TCPRuleFunc(func(t *TCPContext) bool {
 		data, err := extractMinecraftData(t)
 		if err != nil {
 			return false
 		}
 
 		return slices.Contains(hosts, data.RequestedHost)
-	}
+	}), "HostMinecraft", hosts...)
 }
 
-func PlayerMinecraft(players ...string) TCPRuleFunc {
-	return func(t *TCPContext) bool {
+func PlayerMinecraft(players ...string) Rule {
+	return withExpr(TCPRuleFunc(func(t *TCPContext) bool {
 		data, err := extractMinecraftData(t)
 		if err != nil {
 			return false
@@ -298,12 +446,11 @@ func PlayerMinecraft(players ...string) TCPRuleFunc {
 		}
 
 		return slices.Contains(players, data.Username)
-	}
+	}), "PlayerMinecraft", players...)
 }
 
-
-func NotPlayerMinecraft(players ...string) TCPRuleFunc {
-	return func(t *TCPContext) bool {
+func NotPlayerMinecraft(players ...string) Rule {
+	return withExpr(TCPRuleFunc(func(t *TCPContext) bool {
 		data, err := extractMinecraftData(t)
 		if err != nil {
 			return false
@@ -314,5 +461,5 @@ func NotPlayerMinecraft(players ...string) TCPRuleFunc {
 		}
 
 		return !slices.Contains(players, data.Username)
-	}
+	}), "NotPlayerMinecraft", players...)
 }
@@ -0,0 +1,474 @@
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type RuleKind string
+
+const (
+	RuleKindAny  RuleKind = "any"
+	RuleKindHTTP RuleKind = "http"
+	RuleKindTCP  RuleKind = "tcp"
+)
+
+type RuleBuilder func(args []string) (Rule, error)
+
+type ruleMatcher struct {
+	kind  RuleKind
+	build RuleBuilder
+}
+
+// RuleParser turns expressions such as
+//
+//	HostMinecraft('vanilla.mc') AND NOT PlayerMinecraft('asdf')
+//
+// into Rule trees using a registry of named matchers. AND binds tighter
+// than OR, and &&, || and ! are accepted as aliases for the keywords.
+type RuleParser struct {
+	mu       sync.RWMutex
+	matchers map[string]ruleMatcher
+}
+
+type RuleSyntaxError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *RuleSyntaxError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+func NewRuleParser() *RuleParser {
+	p := &RuleParser{
+		matchers: make(map[string]ruleMatcher),
+	}
+
+	p.RegisterMatcher("Any", RuleKindAny, func(args []string) (Rule, error) {
+		if err := expectArgs(args, 0); err != nil {
+			return nil, err
+		}
+		return Any(), nil
+	})
+
+	p.RegisterMatcher("ALPN", RuleKindAny, variadicArgs(ALPN))
+	p.RegisterMatcher("ProxyAuthority", RuleKindAny, variadicArgs(ProxyAuthority))
+	p.RegisterMatcher("ProxyVPCEndpoint", RuleKindAny, variadicArgs(ProxyVPCEndpoint))
+	p.RegisterMatcher("Host", RuleKindHTTP, singleArg(Host))
+	p.RegisterMatcher("Path", RuleKindHTTP, singleArg(Path))
+	p.RegisterMatcher("PathPrefix", RuleKindHTTP, singleArg(PathPrefix))
+	p.RegisterMatcher("Method", RuleKindHTTP, singleArg(Method))
+	p.RegisterMatcher("PathRegexp", RuleKindHTTP, func(args []string) (Rule, error) {
+		if err := expectArgs(args, 1); err != nil {
+			return nil, err
+		}
+		if _, err := regexp.Compile(args[0]); err != nil {
+			return nil, fmt.Errorf("Invalid regular expression: %s", err)
+		}
+		return PathRegexp(args[0]), nil
+	})
+
+	p.RegisterMatcher("HostSNI", RuleKindTCP, singleArg(HostSNI))
+	p.RegisterMatcher("Protocol", RuleKindTCP, variadicArgs(SniffedProtocol))
+	p.RegisterMatcher("ClientCertSubject", RuleKindTCP, variadicArgs(ClientCertSubject))
+	p.RegisterMatcher("ClientCertFingerprint", RuleKindTCP, variadicArgs(ClientCertFingerprint))
+	p.RegisterMatcher("HostMinecraft", RuleKindTCP, variadicArgs(HostMinecraft))
+	p.RegisterMatcher("PlayerMinecraft", RuleKindTCP, variadicArgs(PlayerMinecraft))
+	p.RegisterMatcher("NotPlayerMinecraft", RuleKindTCP, variadicArgs(NotPlayerMinecraft))
+
+	return p
+}
+
+var defaultRuleParser = NewRuleParser()
+
+// DefaultRuleParser is used by ParseRule, ParseHTTPRule and ParseTCPRule.
+// Matchers registered on it are available to every config.
+func DefaultRuleParser() *RuleParser {
+	return defaultRuleParser
+}
+
+func ParseRule(expr string) (Rule, error) {
+	return defaultRuleParser.Parse(expr, RuleKindAny)
+}
+
+func ParseHTTPRule(expr string) (Rule, error) {
+	return defaultRuleParser.Parse(expr, RuleKindHTTP)
+}
+
+func ParseTCPRule(expr string) (Rule, error) {
+	return defaultRuleParser.Parse(expr, RuleKindTCP)
+}
+
+func (p *RuleParser) RegisterMatcher(name string, kind RuleKind, build RuleBuilder) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.matchers[name] = ruleMatcher{
+		kind:  kind,
+		build: build,
+	}
+}
+
+func (p *RuleParser) DeregisterMatcher(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.matchers, name)
+}
+
+func (p *RuleParser) matcher(name string) (ruleMatcher, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m, ok := p.matchers[name]
+	return m, ok
+}
+
+// Parse builds a Rule from expr. Matchers of a different kind than the one
+// requested are rejected, RuleKindAny accepts every matcher.
+func (p *RuleParser) Parse(expr string, kind RuleKind) (Rule, error) {
+	tokens, err := lexRule(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &ruleParserState{
+		parser: p,
+		kind:   kind,
+		tokens: tokens,
+	}
+
+	rule, err := state.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := state.peek(); tok.kind != tokenEOF {
+		return nil, tok.errorf("Unexpected %s after end of rule", tok)
+	}
+
+	return rule, nil
+}
+
+func expectArgs(args []string, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("Expected %d arguments but got %d", n, len(args))
+	}
+	return nil
+}
+
+func singleArg(f func(string) Rule) RuleBuilder {
+	return func(args []string) (Rule, error) {
+		if err := expectArgs(args, 1); err != nil {
+			return nil, err
+		}
+		return f(args[0]), nil
+	}
+}
+
+func variadicArgs(f func(...string) Rule) RuleBuilder {
+	return func(args []string) (Rule, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("Expected at least 1 argument")
+		}
+		return f(args...), nil
+	}
+}
+
+type ruleTokenKind int
+
+const (
+	tokenEOF ruleTokenKind = iota
+	tokenIdent
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenAnd
+	tokenOr
+	tokenNot
+)
+
+type ruleToken struct {
+	kind   ruleTokenKind
+	value  string
+	line   int
+	column int
+}
+
+func (t ruleToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of rule"
+	case tokenString:
+		return fmt.Sprintf("string '%s'", t.value)
+	default:
+		return fmt.Sprintf("\"%s\"", t.value)
+	}
+}
+
+func (t ruleToken) errorf(format string, args ...any) error {
+	return &RuleSyntaxError{
+		Line:   t.line,
+		Column: t.column,
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+func isIdentRune(r rune, first bool) bool {
+	switch {
+	case r == '_':
+		return true
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return true
+	case r >= '0' && r <= '9':
+		return !first
+	}
+	return false
+}
+
+func lexRule(expr string) ([]ruleToken, error) {
+	var tokens []ruleToken
+
+	runes := []rune(expr)
+	line, column := 1, 1
+
+	advance := func(n int) {
+		for range n {
+			if runes[0] == '\n' {
+				line++
+				column = 1
+			} else {
+				column++
+			}
+			runes = runes[1:]
+		}
+	}
+
+	for len(runes) > 0 {
+		r := runes[0]
+		start := ruleToken{line: line, column: column}
+
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			advance(1)
+			continue
+		case r == '(':
+			start.kind, start.value = tokenLParen, "("
+			advance(1)
+		case r == ')':
+			start.kind, start.value = tokenRParen, ")"
+			advance(1)
+		case r == ',':
+			start.kind, start.value = tokenComma, ","
+			advance(1)
+		case r == '!':
+			start.kind, start.value = tokenNot, "!"
+			advance(1)
+		case r == '&' || r == '|':
+			if len(runes) < 2 || runes[1] != r {
+				return nil, start.errorf("Unexpected character '%c', did you mean '%c%c'", r, r, r)
+			}
+			start.kind, start.value = tokenAnd, "&&"
+			if r == '|' {
+				start.kind, start.value = tokenOr, "||"
+			}
+			advance(2)
+		case r == '\'' || r == '"' || r == '`':
+			var sb strings.Builder
+			advance(1)
+			for {
+				if len(runes) == 0 {
+					return nil, start.errorf("Unterminated string")
+				}
+				c := runes[0]
+				if c == r {
+					advance(1)
+					break
+				}
+				// Only the quote and the backslash itself are escaped, any
+				// other backslash is kept so regexps read as written
+				if c == '\\' && r != '`' && len(runes) > 1 && (runes[1] == r || runes[1] == '\\') {
+					advance(1)
+					c = runes[0]
+				}
+				sb.WriteRune(c)
+				advance(1)
+			}
+			start.kind, start.value = tokenString, sb.String()
+		case isIdentRune(r, true):
+			n := 0
+			for n < len(runes) && isIdentRune(runes[n], n == 0) {
+				n++
+			}
+			word := string(runes[:n])
+			advance(n)
+
+			start.kind, start.value = tokenIdent, word
+			switch strings.ToUpper(word) {
+			case "AND":
+				start.kind = tokenAnd
+			case "OR":
+				start.kind = tokenOr
+			case "NOT":
+				start.kind = tokenNot
+			}
+		default:
+			return nil, start.errorf("Unexpected character '%c'", r)
+		}
+
+		tokens = append(tokens, start)
+	}
+
+	return append(tokens, ruleToken{kind: tokenEOF, line: line, column: column}), nil
+}
+
+type ruleParserState struct {
+	parser *RuleParser
+	kind   RuleKind
+	tokens []ruleToken
+	pos    int
+}
+
+func (s *ruleParserState) peek() ruleToken {
+	return s.tokens[s.pos]
+}
+
+func (s *ruleParserState) next() ruleToken {
+	tok := s.tokens[s.pos]
+	if tok.kind != tokenEOF {
+		s.pos++
+	}
+	return tok
+}
+
+func (s *ruleParserState) expect(kind ruleTokenKind, what string) (ruleToken, error) {
+	tok := s.next()
+	if tok.kind != kind {
+		return tok, tok.errorf("Expected %s but found %s", what, tok)
+	}
+	return tok, nil
+}
+
+func (s *ruleParserState) parseOr() (Rule, error) {
+	rule, err := s.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []Rule{rule}
+	for s.peek().kind == tokenOr {
+		s.next()
+		rule, err := s.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if len(rules) == 1 {
+		return rules[0], nil
+	}
+	return Or(rules...), nil
+}
+
+func (s *ruleParserState) parseAnd() (Rule, error) {
+	rule, err := s.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []Rule{rule}
+	for s.peek().kind == tokenAnd {
+		s.next()
+		rule, err := s.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if len(rules) == 1 {
+		return rules[0], nil
+	}
+	return And(rules...), nil
+}
+
+func (s *ruleParserState) parseUnary() (Rule, error) {
+	if s.peek().kind == tokenNot {
+		s.next()
+		rule, err := s.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(rule), nil
+	}
+	return s.parsePrimary()
+}
+
+func (s *ruleParserState) parsePrimary() (Rule, error) {
+	tok := s.next()
+
+	switch tok.kind {
+	case tokenLParen:
+		rule, err := s.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.expect(tokenRParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return rule, nil
+	case tokenIdent:
+		return s.parseMatcher(tok)
+	default:
+		return nil, tok.errorf("Expected a matcher or \"(\" but found %s", tok)
+	}
+}
+
+func (s *ruleParserState) parseMatcher(name ruleToken) (Rule, error) {
+	m, ok := s.parser.matcher(name.value)
+	if !ok {
+		return nil, name.errorf("Unknown matcher \"%s\"", name.value)
+	}
+
+	if s.kind != RuleKindAny && m.kind != RuleKindAny && m.kind != s.kind {
+		return nil, name.errorf(
+			"Matcher \"%s\" can only be used in %s rules",
+			name.value,
+			m.kind,
+		)
+	}
+
+	if _, err := s.expect(tokenLParen, "\"(\""); err != nil {
+		return nil, err
+	}
+
+	var args []string
+	if s.peek().kind != tokenRParen {
+		for {
+			arg, err := s.expect(tokenString, "a quoted argument")
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg.value)
+
+			if s.peek().kind != tokenComma {
+				break
+			}
+			s.next()
+		}
+	}
+
+	if _, err := s.expect(tokenRParen, "\")\""); err != nil {
+		return nil, err
+	}
+
+	rule, err := m.build(args)
+	if err != nil {
+		return nil, name.errorf("%s: %s", name.value, err)
+	}
+
+	return rule, nil
+}
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRuleEscapes(t *testing.T) {
+	tests := []struct {
+		expr  string
+		match []string
+		miss  []string
+	}{
+		{`PathRegexp('^/a\.b$')`, []string{"/a.b"}, []string{"/axb"}},
+		{`PathRegexp("^/a\.b$")`, []string{"/a.b"}, []string{"/axb"}},
+		{"PathRegexp(`^/a\\.b$`)", []string{"/a.b"}, []string{"/axb"}},
+		{`PathRegexp('^/v\d+/')`, []string{"/v2/users"}, []string{"/vx/users"}},
+		{`PathRegexp('^/a\\\\b$')`, []string{`/a\b`}, []string{"/ab"}},
+		{`Path('/it\'s')`, []string{"/it's"}, []string{`/it\'s`}},
+		{`Path("/say \"hi\"")`, []string{`/say "hi"`}, nil},
+		{`Path('/back\\slash')`, []string{`/back\slash`}, nil},
+		{`Path('/keep\n')`, []string{`/keep\n`}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			rule, err := ParseHTTPRule(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The expression a rule prints must parse back to the same rule
+			roundTripped, err := ParseHTTPRule(RuleString(rule))
+			if err != nil {
+				t.Fatalf("parsing %s: %s", RuleString(rule), err)
+			}
+			if RuleString(roundTripped) != RuleString(rule) {
+				t.Errorf("%s printed back as %s", RuleString(rule), RuleString(roundTripped))
+			}
+
+			for _, r := range []Rule{rule, roundTripped} {
+				for _, path := range test.match {
+					if !r.Match(pathRequest(path)) {
+						t.Errorf("%s does not match %s", RuleString(r), path)
+					}
+				}
+				for _, path := range test.miss {
+					if r.Match(pathRequest(path)) {
+						t.Errorf("%s matches %s", RuleString(r), path)
+					}
+				}
+			}
+		})
+	}
+}
+
+func pathRequest(path string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://test/", nil)
+	r.URL.Path = path
+	return r
+}
+
+func TestWithExprEscapes(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		want string
+	}{
+		{PathRegexp(`^/a\.b$`), `PathRegexp('^/a\\.b$')`},
+		{Path(`/it's`), `Path('/it\'s')`},
+		{Host("example.com"), `Host('example.com')`},
+	}
+
+	for _, test := range tests {
+		if got := RuleString(test.rule); got != test.want {
+			t.Errorf("printed %s, want %s", got, test.want)
+		}
+	}
+}
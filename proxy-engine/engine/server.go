@@ -3,35 +3,71 @@ package engine
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
 )
 
 type Server struct {
-	mu                sync.Mutex
-	listeners         map[string]net.Listener
-	tlsConfigHandlers map[string]TLSConfigHandler
-	addEntryPoint     chan EntryPoint
-	removeEntryPoint  chan string
-	filter            ConnFilter
+	mu               sync.Mutex
+	entryPoints      map[string]*entryPointState
+	drainPolicies    map[string]DrainPolicy
+	handlers         *snapshotMap[entryPointHandlers]
+	entryPointEvents chan entryPointEvent
+	filter           ConnFilter
+	sniffers         *SnifferRegistry
+	conns            *connRegistry
+	closed           bool
+	done             chan struct{}
+	closeOnce        sync.Once
+	drainCtx         context.Context
+	drain            context.CancelFunc
 
 	tcpRuntime  *TCPRuntime
 	httpRuntime *HTTPRuntime
+
+	// Entrypoints that label silent connections SniffServerFirst
+	serverFirstTimeouts map[string]time.Duration
+	handshakeTimeout    atomic.Int64
 }
 
-const initBufferSize = 100
+const (
+	initBufferSize = 100
+
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+var ErrServerClosed = errors.New("Server closed")
+
+// Adding and removing entrypoints share a channel so that a remove
+// followed by an add of the same id is applied in order.
+type entryPointEvent struct {
+	add    EntryPoint
+	remove string
+}
 
 func NewServer() *Server {
+	drainCtx, drain := context.WithCancel(context.Background())
 	return &Server{
-		listeners:         make(map[string]net.Listener),
-		tlsConfigHandlers: make(map[string]TLSConfigHandler),
-		addEntryPoint:     make(chan EntryPoint, initBufferSize),
-		removeEntryPoint:  make(chan string, initBufferSize),
-		tcpRuntime:        NewTCPRuntime(),
-		httpRuntime:       NewHTTPRuntime(),
-		filter:            nil,
+		entryPoints:         make(map[string]*entryPointState),
+		drainPolicies:       make(map[string]DrainPolicy),
+		serverFirstTimeouts: make(map[string]time.Duration),
+		handlers:            newSnapshotMap[entryPointHandlers](),
+		entryPointEvents:    make(chan entryPointEvent, initBufferSize),
+		tcpRuntime:          NewTCPRuntime(),
+		httpRuntime:         NewHTTPRuntime(),
+		filter:              nil,
+		sniffers:            NewSnifferRegistry(DefaultSniffTimeout, DefaultSniffers()...),
+		conns:               newConnRegistry(),
+		done:                make(chan struct{}),
+		drainCtx:            drainCtx,
+		drain:               drain,
 	}
 }
 
@@ -39,41 +75,82 @@ func (s *Server) SetFilter(filter ConnFilter) {
 	s.filter = filter
 }
 
+// RegisterSniffer replaces the sniffer for the same protocol, or adds one
+// that is tried before the rest.
+func (s *Server) RegisterSniffer(sniffer Sniffer) {
+	s.sniffers.Register(sniffer)
+}
+
+// SetSniffTimeout bounds how long a new connection may take to show what
+// protocol it speaks.
+func (s *Server) SetSniffTimeout(timeout time.Duration) {
+	s.sniffers.SetTimeout(timeout)
+}
+
+// SetTLSHandshakeTimeout bounds how long a client has to finish the
+// handshake of TLS the server terminates, zero restores
+// DefaultTLSHandshakeTimeout.
+func (s *Server) SetTLSHandshakeTimeout(timeout time.Duration) {
+	s.handshakeTimeout.Store(int64(timeout))
+}
+
+func (s *Server) tlsHandshakeTimeout() time.Duration {
+	if timeout := s.handshakeTimeout.Load(); timeout > 0 {
+		return time.Duration(timeout)
+	}
+	return DefaultTLSHandshakeTimeout
+}
+
+// SetServerFirstTimeout sets how long a silent connection to the
+// entrypoint is given before it is labelled SniffServerFirst, see
+// SnifferRegistry.SniffWithServerFirst. It is off unless set, and applies
+// from the next time the entrypoint is registered.
+func (s *Server) SetServerFirstTimeout(entryPointId string, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serverFirstTimeouts[entryPointId] = timeout
+}
+
 func (s *Server) Serve(ctx context.Context) error {
 	for {
 		select {
-		case e := <-s.addEntryPoint:
-			s.startEntryPoint(ctx, e)
-		case id := <-s.removeEntryPoint:
-			s.stopEntryPoint(id)
+		case event := <-s.entryPointEvents:
+			if event.add != nil {
+				s.startEntryPoint(ctx, event.add)
+			} else {
+				s.stopEntryPoint(event.remove)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.done:
+			return ErrServerClosed
 		}
 	}
 }
 
-func (s *Server) acceptLoop(ctx context.Context, e string, ln net.Listener) {
-	cancelCtx, cancel := context.WithCancel(ctx)
-
+// The context handed to connections is cancelled when they should start
+// draining. Runtimes finish in-flight work on cancellation, anything left
+// over is force closed through the connection registry.
+func (s *Server) acceptLoop(ctx context.Context, e string, ep *entryPointState) {
 	for {
-		conn, err := ln.Accept()
+		conn, err := ep.listener.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
-				cancel()
 				return
 			default:
 			}
 		}
 
 		if conn == nil {
-			cancel()
 			return
 		}
 
-		go s.handleConnection(cancelCtx, e, conn)
+		go s.handleConnection(ctx, e, ep, conn)
 	}
 }
 
-func (s *Server) handleTLSConnection(ctx context.Context, e string, conn BufferedConn) {
+func (s *Server) handleTLSConnection(ctx context.Context, e string, handlers entryPointHandlers, conn BufferedConn) {
 	log.Printf("%s | Handling connection as TLS\n", conn.RemoteAddr().String())
 
 	transport, err := GetTransport(conn.LocalAddr())
@@ -83,8 +160,8 @@ func (s *Server) handleTLSConnection(ctx context.Context, e string, conn Buffere
 
 	switch transport {
 	case TransportTCP:
-		if s.tcpRuntime.Claim(e, NewTCPContext(conn)) {
-			s.tcpRuntime.Handle(ctx, e, conn)
+		if s.tcpRuntime.Claim(handlers.tcp, NewTCPContext(conn)) {
+			s.tcpRuntime.Handle(ctx, handlers.tcp, conn)
 			return
 		}
 	default:
@@ -99,8 +176,8 @@ func (s *Server) handleTLSConnection(ctx context.Context, e string, conn Buffere
 
 	// terminate tls and check if http router claims
 
-	tlsConfigHandler, ok := s.tlsConfigHandlers[e]
-	if !ok {
+	tlsConfigHandler := handlers.tlsConfig
+	if tlsConfigHandler == nil {
 		log.Printf(
 			"%s | TLS config compiler not configured for the entrypoint %s\n",
 			conn.RemoteAddr().String(),
@@ -127,9 +204,11 @@ func (s *Server) handleTLSConnection(ctx context.Context, e string, conn Buffere
 		return
 	}
 
-	tlsConn := tls.Server(conn, tlsConfig)
+	tlsConn := tls.Server(conn, negotiableALPN(tlsConfig, tlsInfo.SupportedProtos))
 
-	err = tlsConn.Handshake()
+	handshakeCtx, cancel := context.WithTimeout(ctx, s.tlsHandshakeTimeout())
+	err = tlsConn.HandshakeContext(handshakeCtx)
+	cancel()
 	if err != nil {
 		log.Printf(
 			"%s | TLS handshake failed with error: %s\n",
@@ -140,8 +219,21 @@ func (s *Server) handleTLSConnection(ctx context.Context, e string, conn Buffere
 		return
 	}
 
-	// Assume protocol is https
-	err = s.httpRuntime.HandleTLSConnection(ctx, e, tlsConn)
+	// A TLS-ALPN-01 validation is over once the handshake is
+	if tlsConn.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		conn.Close()
+		return
+	}
+
+	// TCP routes that asked for termination get the plaintext stream
+	tcpConn := NewBufferedTLSConn(tlsConn, tlsInfo.SupportedProtos)
+	if s.tcpRuntime.Claim(handlers.tcp, NewTCPContext(tcpConn)) {
+		s.tcpRuntime.Handle(ctx, handlers.tcp, tcpConn)
+		return
+	}
+
+	// Otherwise assume protocol is https
+	err = s.httpRuntime.HandleTLSConnection(ctx, handlers.http, tcpConn)
 	if err != nil {
 		log.Printf(
 			"%s | HTTP runtime failed to handle TLS connection with error: %s\n",
@@ -152,7 +244,7 @@ func (s *Server) handleTLSConnection(ctx context.Context, e string, conn Buffere
 	}
 }
 
-func (s *Server) handleRawConnection(ctx context.Context, e string, conn BufferedConn) {
+func (s *Server) handleRawConnection(ctx context.Context, handlers entryPointHandlers, conn BufferedConn) {
 	log.Printf("%s | Handling connection as raw\n", conn.RemoteAddr().String())
 
 	transport, err := GetTransport(conn.LocalAddr())
@@ -161,13 +253,12 @@ func (s *Server) handleRawConnection(ctx context.Context, e string, conn Buffere
 		return
 	}
 
-	// Check if connection is HTTP/1.1 and a match
-	if s.httpRuntime.Claim(e, conn) {
+	if s.httpRuntime.Claim(handlers.http, conn) {
 		log.Printf(
-			"%s | Raw connection determined to be HTTP/1.1\n",
+			"%s | Raw connection determined to be HTTP\n",
 			conn.RemoteAddr().String(),
 		)
-		err = s.httpRuntime.HandleRawConnection(ctx, e, conn)
+		err = s.httpRuntime.HandleRawConnection(ctx, handlers.http, conn)
 		if err != nil {
 			log.Printf(
 				"%s | HTTP runtime failed to handle raw connection with error: %s\n",
@@ -182,8 +273,8 @@ func (s *Server) handleRawConnection(ctx context.Context, e string, conn Buffere
 	// Otherwise send to fallback
 	switch transport {
 	case TransportTCP:
-		if s.tcpRuntime.Claim(e, NewTCPContext(conn)) {
-			s.tcpRuntime.Handle(ctx, e, conn)
+		if s.tcpRuntime.Claim(handlers.tcp, NewTCPContext(conn)) {
+			s.tcpRuntime.Handle(ctx, handlers.tcp, conn)
 			return
 		}
 	case TransportUDP:
@@ -206,12 +297,29 @@ func (f ConnFilterFunc) KeepConnection(conn net.Conn) bool {
 	return f(conn)
 }
 
-func (s *Server) handleConnection(ctx context.Context, e string, conn net.Conn) {
+func (s *Server) handleConnection(ctx context.Context, e string, ep *entryPointState, conn net.Conn) {
 	if conn == nil {
 		log.Println("net.Conn is nil")
 		return
 	}
 
+	if !s.conns.Add(conn) {
+		conn.Close()
+		return
+	}
+
+	if !ep.conns.Add(conn) {
+		conn.Close()
+		s.conns.Remove(conn)
+		return
+	}
+
+	defer func() {
+		conn.Close()
+		ep.conns.Remove(conn)
+		s.conns.Remove(conn)
+	}()
+
 	if s.filter != nil && !s.filter.KeepConnection(conn) {
 		conn.Close()
 		return
@@ -229,26 +337,43 @@ func (s *Server) handleConnection(ctx context.Context, e string, conn net.Conn)
 		e,
 	)
 
-	isClientHello, err := CheckForClientHello(bufferedConn)
+	protocol, err := s.sniffers.SniffWithServerFirst(bufferedConn, ep.serverFirstTimeout)
 	if err != nil {
+		log.Printf(
+			"%s | Failed to sniff protocol with error: %s\n",
+			conn.RemoteAddr().String(),
+			err,
+		)
 		conn.Close()
 		return
 	}
 
+	bufferedConn.SetProtocol(protocol)
+
+	log.Printf(
+		"%s | Sniffed protocol \"%s\"\n",
+		conn.RemoteAddr().String(),
+		protocol,
+	)
+
 	// Connection using tls, need to figure out if decryption is needed.
 	// It is the Servers sole responsibility to handle decryption when needed.
 	// The Server can ask the routers what certs to use.
-	if isClientHello {
-		if _, ok := s.tlsConfigHandlers[e]; ok {
-			s.handleTLSConnection(ctx, e, bufferedConn)
+	// The handlers are looked up once so a reload never routes one
+	// connection with parts of two configs.
+	handlers, _ := s.handlers.Get(e)
+	if protocol == SniffTLS {
+		if handlers.tlsConfig != nil {
+			s.handleTLSConnection(ctx, e, handlers, bufferedConn)
 		} else {
 			log.Printf(
 				"%s | TLS connection recieved but no config compiler is available to handle it\n",
 				conn.RemoteAddr().String(),
 			)
+			conn.Close()
 		}
 	} else {
-		s.handleRawConnection(ctx, e, bufferedConn)
+		s.handleRawConnection(ctx, handlers, bufferedConn)
 	}
 }
 
@@ -256,7 +381,11 @@ func (s *Server) startEntryPoint(ctx context.Context, e EntryPoint) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.listeners[e.Id()]; exists {
+	if s.closed {
+		return
+	}
+
+	if _, exists := s.entryPoints[e.Id()]; exists {
 		return
 	}
 
@@ -266,53 +395,236 @@ func (s *Server) startEntryPoint(ctx context.Context, e EntryPoint) {
 		return
 	}
 
-	s.listeners[e.Id()] = ln
+	connCtx, drain := context.WithCancel(ctx)
+	context.AfterFunc(s.drainCtx, drain)
 
-	go s.acceptLoop(ctx, e.Id(), ln)
+	ep := &entryPointState{
+		listener:           ln,
+		conns:              newConnRegistry(),
+		drain:              drain,
+		serverFirstTimeout: s.serverFirstTimeouts[e.Id()],
+	}
+
+	s.entryPoints[e.Id()] = ep
+
+	go s.acceptLoop(connCtx, e.Id(), ep)
 }
 
 func (s *Server) stopEntryPoint(id string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if ln, ok := s.listeners[id]; ok {
-		ln.Close()
-		delete(s.listeners, id)
+	ep, ok := s.entryPoints[id]
+	if !ok {
+		return
+	}
+
+	ep.listener.Close()
+	ep.conns.Close()
+	delete(s.entryPoints, id)
+
+	policy, ok := s.drainPolicies[id]
+	if !ok {
+		policy = DefaultDrainPolicy
 	}
+
+	go s.drainEntryPoint(id, ep, policy)
 }
 
-func (s *Server) Shutdown(ctx context.Context) {
+func (s *Server) drainEntryPoint(id string, ep *entryPointState, policy DrainPolicy) {
+	log.Printf(
+		"Draining %d connections from entrypoint \"%s\" with policy \"%s\"\n",
+		ep.conns.Len(),
+		id,
+		policy.Mode,
+	)
+
+	ep.drain()
+
+	switch policy.Mode {
+	case DrainImmediate:
+		ep.conns.CloseAll()
+	case DrainGrace:
+		ctx, cancel := context.WithTimeout(context.Background(), policy.Timeout)
+		defer cancel()
+		if err := ep.conns.Wait(ctx); err != nil {
+			log.Printf(
+				"Force closing %d connections from entrypoint \"%s\"\n",
+				ep.conns.Len(),
+				id,
+			)
+			ep.conns.CloseAll()
+		}
+	case DrainWait:
+		// Connections are left to close on their own
+	}
+
+	ep.conns.Wait(context.Background())
 
+	log.Printf("Entrypoint \"%s\" drained\n", id)
+}
+
+// Shutdown stops every listener and the Serve loop, then lets open
+// connections drain. HTTP connections finish their in-flight requests and
+// TCP proxies keep streaming until ctx is done, at which point anything
+// still open is force closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+
+	s.mu.Lock()
+	s.closed = true
+	for id, ep := range s.entryPoints {
+		ep.listener.Close()
+		ep.conns.Close()
+		delete(s.entryPoints, id)
+	}
+	s.mu.Unlock()
+
+	s.conns.Close()
+	s.drain()
+
+	log.Printf("Draining %d connections\n", s.conns.Len())
+
+	err := s.conns.Wait(ctx)
+	if err != nil {
+		log.Printf("Force closing %d connections\n", s.conns.Len())
+		s.conns.CloseAll()
+	}
+
+	return err
 }
 
 func (s *Server) RegisterEntryPoint(e EntryPoint) {
-	s.addEntryPoint <- e
+	s.entryPointEvents <- entryPointEvent{add: e}
 }
 
 func (s *Server) DeregisterEntryPoint(id string) {
-	s.removeEntryPoint <- id
+	s.entryPointEvents <- entryPointEvent{remove: id}
+}
+
+// SetDrainPolicy decides what happens to open connections when the
+// entrypoint is deregistered. Entrypoints without a policy use
+// DefaultDrainPolicy.
+func (s *Server) SetDrainPolicy(entryPointId string, policy DrainPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drainPolicies[entryPointId] = policy
+}
+
+// Handlers holds the handlers of every entrypoint, keyed by entrypoint id.
+type Handlers struct {
+	HTTP      map[string]http.Handler
+	TCP       map[string]TCPHandler
+	TLSConfig map[string]TLSConfigHandler
+}
+
+// entryPointHandlers is what a connection to one entrypoint is routed
+// with. Any of them may be nil.
+type entryPointHandlers struct {
+	http      http.Handler
+	tcp       TCPHandler
+	tlsConfig TLSConfigHandler
+}
+
+func (h entryPointHandlers) empty() bool {
+	return h.http == nil && h.tcp == nil && h.tlsConfig == nil
+}
+
+// setHandler changes the handlers of one entrypoint in data, dropping the
+// entrypoint once it is left without any.
+func setHandler(data map[string]entryPointHandlers, id string, set func(h *entryPointHandlers)) {
+	h := data[id]
+	set(&h)
+	if h.empty() {
+		delete(data, id)
+	} else {
+		data[id] = h
+	}
+}
+
+// ReplaceHandlers publishes the HTTP, TCP and TLS config handlers of every
+// entrypoint in one step, a connection sees either all of the old ones or
+// all of the new ones. Entrypoints missing from handlers are left without
+// one.
+func (s *Server) ReplaceHandlers(handlers Handlers) {
+	data := make(map[string]entryPointHandlers)
+	for id, handler := range handlers.HTTP {
+		setHandler(data, id, func(h *entryPointHandlers) { h.http = handler })
+	}
+	for id, handler := range handlers.TCP {
+		setHandler(data, id, func(h *entryPointHandlers) { h.tcp = handler })
+	}
+	for id, handler := range handlers.TLSConfig {
+		setHandler(data, id, func(h *entryPointHandlers) { h.tlsConfig = handler })
+	}
+	s.handlers.Replace(data)
 }
 
 func (s *Server) RegisterHTTPHandler(entryPointId string, handler http.Handler) {
-	s.httpRuntime.RegisterHandler(entryPointId, handler)
+	s.handlers.Update(func(data map[string]entryPointHandlers) {
+		setHandler(data, entryPointId, func(h *entryPointHandlers) { h.http = handler })
+	})
 }
 
 func (s *Server) DeregisterHTTPHandler(entryPointId string) {
-	s.httpRuntime.DeregisterHandler(entryPointId)
+	s.RegisterHTTPHandler(entryPointId, nil)
+}
+
+// ReplaceHTTPHandlers publishes a complete set of HTTP handlers in one
+// step. Entrypoints missing from handlers are left without one.
+func (s *Server) ReplaceHTTPHandlers(handlers map[string]http.Handler) {
+	s.handlers.Update(func(data map[string]entryPointHandlers) {
+		for id := range data {
+			setHandler(data, id, func(h *entryPointHandlers) { h.http = nil })
+		}
+		for id, handler := range handlers {
+			setHandler(data, id, func(h *entryPointHandlers) { h.http = handler })
+		}
+	})
 }
 
 func (s *Server) RegisterTCPHandler(entryPointId string, handler TCPHandler) {
-	s.tcpRuntime.RegisterHandler(entryPointId, handler)
+	s.handlers.Update(func(data map[string]entryPointHandlers) {
+		setHandler(data, entryPointId, func(h *entryPointHandlers) { h.tcp = handler })
+	})
 }
 
 func (s *Server) DeregisterTCPHandler(entryPointId string) {
-	s.tcpRuntime.DeregisterHandler(entryPointId)
+	s.RegisterTCPHandler(entryPointId, nil)
+}
+
+// ReplaceTCPHandlers publishes a complete set of TCP handlers in one
+// step. Entrypoints missing from handlers are left without one.
+func (s *Server) ReplaceTCPHandlers(handlers map[string]TCPHandler) {
+	s.handlers.Update(func(data map[string]entryPointHandlers) {
+		for id := range data {
+			setHandler(data, id, func(h *entryPointHandlers) { h.tcp = nil })
+		}
+		for id, handler := range handlers {
+			setHandler(data, id, func(h *entryPointHandlers) { h.tcp = handler })
+		}
+	})
 }
 
 func (s *Server) RegisterTLSConfigHandler(entryPointId string, tls TLSConfigHandler) {
-	s.tlsConfigHandlers[entryPointId] = tls
+	s.handlers.Update(func(data map[string]entryPointHandlers) {
+		setHandler(data, entryPointId, func(h *entryPointHandlers) { h.tlsConfig = tls })
+	})
 }
 
 func (s *Server) DeregisterTLSConfigHandler(entryPointId string) {
-	delete(s.tlsConfigHandlers, entryPointId)
+	s.RegisterTLSConfigHandler(entryPointId, nil)
+}
+
+func (s *Server) ReplaceTLSConfigHandlers(handlers map[string]TLSConfigHandler) {
+	s.handlers.Update(func(data map[string]entryPointHandlers) {
+		for id := range data {
+			setHandler(data, id, func(h *entryPointHandlers) { h.tlsConfig = nil })
+		}
+		for id, handler := range handlers {
+			setHandler(data, id, func(h *entryPointHandlers) { h.tlsConfig = handler })
+		}
+	})
 }
@@ -0,0 +1,287 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenerEntryPoint serves an already open listener, so tests know the
+// address before the server starts.
+type listenerEntryPoint struct {
+	id       string
+	listener net.Listener
+}
+
+func (e listenerEntryPoint) Id() string                    { return e.id }
+func (e listenerEntryPoint) Listen() (net.Listener, error) { return e.listener, nil }
+
+func quietLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func startTestServer(t *testing.T, s *Server, id string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Serve(ctx)
+	s.RegisterEntryPoint(listenerEntryPoint{id: id, listener: listener})
+
+	t.Cleanup(func() {
+		shutdownCtx, done := context.WithTimeout(context.Background(), time.Second)
+		defer done()
+		s.Shutdown(shutdownCtx)
+		cancel()
+	})
+
+	return listener.Addr().String()
+}
+
+// versionHandler answers every request with its version.
+func versionHandler(version int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "v%d", version)
+	})
+}
+
+// TestServerRegistrationDuringTraffic swaps routes, compiled handlers and
+// TLS config handlers while HTTP and raw TCP clients keep the entrypoint
+// busy. Run it with -race, every request must see a complete snapshot.
+func TestServerRegistrationDuringTraffic(t *testing.T) {
+	quietLog(t)
+
+	const (
+		clients  = 8
+		requests = 50
+	)
+
+	s := NewServer()
+
+	compiler := NewHTTPHandlerCompiler()
+	compiler.RegisterService("svc", versionHandler(0))
+	compiler.RegisterRouter("router").RegisterRoute("route", &HTTPRoute{Rule: Any(), ServiceId: "svc"})
+	s.RegisterHTTPHandler("web", compiler.Compile("router"))
+
+	echo := TCPHandlerFunc(func(conn *BufferedTCPConn) {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte(line))
+	}, Any())
+	s.RegisterTCPHandler("web", echo)
+
+	addr := startTestServer(t, s, "web")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients*requests*2)
+
+	for range clients {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			client := &http.Client{Transport: &http.Transport{}}
+			defer client.CloseIdleConnections()
+
+			for range requests {
+				res, err := client.Get("http://" + addr + "/")
+				if err != nil {
+					errs <- err
+					continue
+				}
+				body, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+
+				if res.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "v") {
+					errs <- fmt.Errorf("status %d body %q", res.StatusCode, body)
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for i := range requests {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					errs <- err
+					continue
+				}
+
+				line := fmt.Sprintf("ping %d from a raw tcp client\n", i)
+				conn.Write([]byte(line))
+				reply, err := bufio.NewReader(conn).ReadString('\n')
+				conn.Close()
+
+				if err != nil || reply != line {
+					errs <- fmt.Errorf("tcp echo %q, %v", reply, err)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	swaps := make(chan int)
+	go func() {
+		i := 1
+		defer func() { swaps <- i }()
+
+		for ; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			compiler.RegisterService("svc", versionHandler(i))
+			compiler.Router("router").RegisterRoute(fmt.Sprintf("route-%d", i%4), &HTTPRoute{Rule: Any(), ServiceId: "svc"})
+			handler := compiler.Compile("router")
+
+			switch i % 4 {
+			case 0:
+				s.RegisterHTTPHandler("web", handler)
+			case 1:
+				s.ReplaceHTTPHandlers(map[string]http.Handler{"web": handler})
+			case 2:
+				s.ReplaceTCPHandlers(map[string]TCPHandler{"web": echo})
+			case 3:
+				s.ReplaceHandlers(Handlers{
+					HTTP: map[string]http.Handler{"web": handler},
+					TCP:  map[string]TCPHandler{"web": echo},
+				})
+			}
+
+			s.RegisterTLSConfigHandler(fmt.Sprintf("tls-%d", i%4), TLSConfigHandlerFunc(nil))
+			s.DeregisterTLSConfigHandler(fmt.Sprintf("tls-%d", (i+2)%4))
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	if n := <-swaps; n < 10 {
+		t.Errorf("only %d swaps happened during traffic", n)
+	}
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotMapConcurrentWriters(t *testing.T) {
+	m := newSnapshotMap[int]()
+
+	var wg sync.WaitGroup
+	for writer := range 8 {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				m.Set(fmt.Sprintf("%d-%d", writer, i), i)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				snapshot := m.Load()
+				for range snapshot {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(m.Load()); n != 800 {
+		t.Errorf("%d keys after concurrent writes, want 800", n)
+	}
+}
+
+func TestServerReplaceHandlers(t *testing.T) {
+	s := NewServer()
+	tcp := TCPHandlerFunc(func(conn *BufferedTCPConn) {}, Any())
+	tlsConfig := TLSConfigHandlerFunc(nil)
+
+	s.RegisterHTTPHandler("a", versionHandler(0))
+	s.RegisterTCPHandler("a", tcp)
+	s.RegisterTLSConfigHandler("b", tlsConfig)
+
+	// Replacing one kind keeps the others
+	s.ReplaceHTTPHandlers(map[string]http.Handler{"b": versionHandler(1)})
+	if h, _ := s.handlers.Get("a"); h.http != nil || h.tcp == nil {
+		t.Errorf("entrypoint a has %+v after replacing HTTP handlers", h)
+	}
+	if h, _ := s.handlers.Get("b"); h.http == nil || h.tlsConfig == nil {
+		t.Errorf("entrypoint b has %+v after replacing HTTP handlers", h)
+	}
+
+	// Replacing everything drops what is missing
+	s.ReplaceHandlers(Handlers{TCP: map[string]TCPHandler{"b": tcp}})
+	if _, ok := s.handlers.Get("a"); ok {
+		t.Error("entrypoint a kept handlers missing from the replacement")
+	}
+	if h, _ := s.handlers.Get("b"); h.http != nil || h.tcp == nil || h.tlsConfig != nil {
+		t.Errorf("entrypoint b has %+v after replacing all handlers", h)
+	}
+}
+
+// stallingConn sends the ClientHello and swallows everything written after
+// it, leaving the server waiting on the rest of the handshake.
+type stallingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *stallingConn) Write(p []byte) (int, error) {
+	c.writes++
+	if c.writes > 1 {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+func TestServerTLSHandshakeTimeout(t *testing.T) {
+	quietLog(t)
+
+	cert, key := newTestCert(t, "stall.test", nil, nil, false)
+
+	s := NewServer()
+	s.SetTLSHandshakeTimeout(100 * time.Millisecond)
+	s.RegisterHTTPHandler("web", versionHandler(1))
+	s.RegisterTLSConfigHandler("web", TLSConfigHandlerFunc(func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{Certificates: []tls.Certificate{tlsCertificate(cert, key)}}, nil
+	}))
+	addr := startTestServer(t, s, "web")
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	conn := tls.Client(&stallingConn{Conn: raw}, &tls.Config{InsecureSkipVerify: true})
+	conn.Handshake()
+
+	// The server gives up on the handshake and closes the connection
+	// long before the client's own deadline
+	raw.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = raw.Read(make([]byte, 1))
+	if err == nil || isTimeout(err) {
+		t.Errorf("read after a stalled handshake returned %v, want the server to close the connection", err)
+	}
+}
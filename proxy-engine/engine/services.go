@@ -1,16 +1,19 @@
 package engine
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
 func UpgradeToSecure() http.Handler {
@@ -25,30 +28,91 @@ func FileServer(dir string) http.Handler {
 }
 
 func HTTPLoadBalancer(services ...http.Handler) http.Handler {
+	return NewHTTPLoadBalancer(LoadBalancerConfig{}, weighEqually(services)...)
+}
+
+func NewHTTPLoadBalancer(config LoadBalancerConfig, members ...LoadBalancerMember[http.Handler]) http.Handler {
+	pool := newBalancerPool(config, members)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		target := services[rand.Uint32()%uint32(len(services))]
-		target.ServeHTTP(w, r)
+		target, done, ok := pool.pick()
+		if !ok {
+			log.Printf("%s | Load balancer has no healthy backends\n", r.RemoteAddr)
+			http.Error(w, "no healthy backend available", http.StatusServiceUnavailable)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			done(recorder.status >= 500)
+		}()
+
+		target.ServeHTTP(recorder, r)
 	})
 }
 
+// HTTPReverseProxy logs an invalid address straight away and answers
+// every request with a 502, use NewHTTPReverseProxy to handle the error.
 func HTTPReverseProxy(address string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		targetURL, err := url.Parse(address)
-		if err != nil {
-			log.Printf("Invalid target address provided: %s. Error: %v", address, err)
-			http.NotFoundHandler()
-		}
+	proxy, err := NewHTTPReverseProxy(address, HTTPReverseProxyConfig{})
+	if err != nil {
+		log.Printf("Invalid target address provided: %s. Error: %v\n", address, err)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "invalid upstream", http.StatusBadGateway)
+		})
+	}
+	return proxy
+}
 
-		proxy := httputil.NewSingleHostReverseProxy(targetURL)
-		originalDirector := proxy.Director // Get the default director logic
+type HTTPReverseProxyConfig struct {
+	// Upstream connections then carry a single client each, so they are
+	// not kept alive for reuse
+	ProxyProtocol *UpstreamProxyProtocol
+	Transport     HTTPTransportConfig
+	// Verifies and authenticates to https upstreams, the server name
+	// defaults to the host of the address
+	TLS *tls.Config
+}
 
-		proxy.Director = func(req *http.Request) {
-			originalDirector(req)
-			req.RequestURI = ""
-		}
+type upstreamProxyHeaderKey struct{}
+
+// NewHTTPReverseProxy proxies to an http or https URL. The proxy and its
+// transport are built once, so connections to the upstream are pooled
+// across requests.
+func NewHTTPReverseProxy(address string, config HTTPReverseProxyConfig) (http.Handler, error) {
+	targetURL, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if targetURL.Scheme != "http" && targetURL.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported scheme \"%s\"", targetURL.Scheme)
+	}
+	if targetURL.Host == "" {
+		return nil, fmt.Errorf("Missing host")
+	}
+	if config.TLS != nil && targetURL.Scheme != "https" {
+		return nil, fmt.Errorf("TLS is only used for https upstreams")
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	originalDirector := proxy.Director // Get the default director logic
 
+	proxy.Director = func(req *http.Request) {
+		originalDirector(req)
+		req.RequestURI = ""
+	}
+
+	proxy.Transport = newHTTPTransport(targetURL, config.Transport, config.TLS, config.ProxyProtocol != nil)
+
+	if config.ProxyProtocol == nil {
+		return proxy, nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := config.ProxyProtocol.header(requestAddrs(r))
+		r = r.WithContext(context.WithValue(r.Context(), upstreamProxyHeaderKey{}, header))
 		proxy.ServeHTTP(w, r)
-	})
+	}), nil
 }
 
 func Redirect(url string) http.Handler {
@@ -81,13 +145,132 @@ func PathRedirect(path string) http.Handler {
 	})
 }
 
+// requestAddrs returns the client and destination of a request along with
+// the SNI and protocol of its TLS.
+func requestAddrs(r *http.Request) (net.Addr, net.Addr, string, string) {
+	var source net.Addr
+	if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		source = net.TCPAddrFromAddrPort(addr)
+	}
+
+	destination, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	var sni, alpn string
+	if r.TLS != nil {
+		sni = r.TLS.ServerName
+		alpn = r.TLS.NegotiatedProtocol
+	}
+
+	return source, destination, sni, alpn
+}
+
 func TCPReverseProxy(address string) TCPServiceFunc {
+	return NewTCPReverseProxy(address, TCPReverseProxyConfig{})
+}
+
+// TCPReverseProxyTLS originates TLS to the backend. The server name is
+// taken from the address when config does not set one.
+func TCPReverseProxyTLS(address string, config *tls.Config) TCPServiceFunc {
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	return NewTCPReverseProxy(address, TCPReverseProxyConfig{TLS: config})
+}
+
+const (
+	DefaultTCPReverseProxyDialTimeout         = 30 * time.Second
+	DefaultTCPReverseProxyTLSHandshakeTimeout = 10 * time.Second
+)
+
+type TCPReverseProxyConfig struct {
+	// Originates TLS to the backend when set
+	TLS           *tls.Config
+	ProxyProtocol *UpstreamProxyProtocol
+	// Defaults to DefaultTCPReverseProxyDialTimeout
+	DialTimeout time.Duration
+	// Defaults to DefaultTCPReverseProxyTLSHandshakeTimeout
+	TLSHandshakeTimeout time.Duration
+}
+
+func NewTCPReverseProxy(address string, config TCPReverseProxyConfig) TCPServiceFunc {
+	tlsConfig := config.TLS
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				tlsConfig.ServerName = host
+			}
+		}
+	}
+
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = DefaultTCPReverseProxyDialTimeout
+	}
+	if config.TLSHandshakeTimeout <= 0 {
+		config.TLSHandshakeTimeout = DefaultTCPReverseProxyTLSHandshakeTimeout
+	}
+	dialer := &net.Dialer{Timeout: config.DialTimeout}
+
+	return proxyTCP(func(conn *BufferedTCPConn) (net.Conn, error) {
+		remote, err := dialer.DialContext(conn.Context(), "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		// The header goes ahead of any TLS, backends read it off the raw
+		// stream
+		if config.ProxyProtocol != nil {
+			sni, alpn := tcpConnNames(conn)
+			header := config.ProxyProtocol.header(conn.RemoteAddr(), conn.LocalAddr(), sni, alpn)
+			if _, err := header.WriteTo(remote); err != nil {
+				remote.Close()
+				return nil, err
+			}
+		}
+
+		if tlsConfig == nil {
+			return remote, nil
+		}
+
+		ctx, cancel := context.WithTimeout(conn.Context(), config.TLSHandshakeTimeout)
+		defer cancel()
+
+		tlsConn := tls.Client(remote, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			remote.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	})
+}
+
+// tcpConnNames returns the SNI and negotiated protocol of a connection,
+// peeking the ClientHello of TLS that is passed through.
+func tcpConnNames(conn *BufferedTCPConn) (string, string) {
+	if state := conn.TLS(); state != nil {
+		return state.ServerName, state.NegotiatedProtocol
+	}
+
+	if conn.Protocol() == SniffTLS {
+		if info, err := PeekTLSClientHelloInfo(conn); err == nil {
+			return info.ServerName, ""
+		}
+	}
+
+	return "", ""
+}
+
+func proxyTCP(dial func(conn *BufferedTCPConn) (net.Conn, error)) TCPServiceFunc {
 	return TCPServiceFunc(func(conn *BufferedTCPConn) {
-		remote, err := net.Dial("tcp", address)
+		remote, err := dial(conn)
 		if err != nil {
 			log.Printf("Failed to dial with error: %s\n", err)
+			conn.reportUpstreamFailure(err)
 			return
 		}
+		defer remote.Close()
 
 		var wc sync.WaitGroup
 
@@ -104,8 +287,44 @@ func TCPReverseProxy(address string) TCPServiceFunc {
 }
 
 func TCPLoadBalancer(services ...TCPServiceFunc) TCPServiceFunc {
+	return NewTCPLoadBalancer(LoadBalancerConfig{}, weighEqually(services)...)
+}
+
+// NewTCPLoadBalancer counts each connection as one request for the whole
+// time it is open, so latency based balancers compare connection lengths.
+func NewTCPLoadBalancer(config LoadBalancerConfig, members ...LoadBalancerMember[TCPServiceFunc]) TCPServiceFunc {
+	pool := newBalancerPool(config, members)
+
 	return TCPServiceFunc(func(conn *BufferedTCPConn) {
-		target := services[rand.Uint32()%uint32(len(services))]
+		target, done, ok := pool.pick()
+		if !ok {
+			log.Printf("%s | Load balancer has no healthy backends\n", conn.RemoteAddr().String())
+			return
+		}
+
+		// Restored afterwards so that a load balancer further out hears
+		// about the failure too
+		outer := conn.upstreamFailed
+		failed := false
+		conn.upstreamFailed = func(err error) {
+			failed = true
+			if outer != nil {
+				outer(err)
+			}
+		}
+		defer func() {
+			conn.upstreamFailed = outer
+			done(failed)
+		}()
+
 		target(conn)
 	})
 }
+
+func weighEqually[T any](services []T) []LoadBalancerMember[T] {
+	members := make([]LoadBalancerMember[T], len(services))
+	for i, service := range services {
+		members[i] = LoadBalancerMember[T]{Service: service, Weight: 1}
+	}
+	return members
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestTCPReverseProxyDialFollowsConnContext drains a connection before its
+// upstream is dialed, the dial must give up rather than connect.
+func TestTCPReverseProxyDialFollowsConnContext(t *testing.T) {
+	quietLog(t)
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var dialErr error
+	conn := &BufferedTCPConn{
+		conn:           server,
+		reader:         bufio.NewReader(server),
+		ctx:            ctx,
+		upstreamFailed: func(err error) { dialErr = err },
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewTCPReverseProxy(upstream.Addr().String(), TCPReverseProxyConfig{DialTimeout: time.Second})(conn)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("proxying a drained connection did not return")
+	}
+
+	if !errors.Is(dialErr, context.Canceled) {
+		t.Errorf("dial failed with %v, want it cancelled with the connection", dialErr)
+	}
+}
+
+// TestTCPReverseProxyTLSHandshakeTimeout proxies to an upstream that
+// accepts but never answers the ClientHello.
+func TestTCPReverseProxyTLSHandshakeTimeout(t *testing.T) {
+	quietLog(t)
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	var dialErr error
+	conn := &BufferedTCPConn{
+		conn:           server,
+		reader:         bufio.NewReader(server),
+		upstreamFailed: func(err error) { dialErr = err },
+	}
+
+	proxy := NewTCPReverseProxy(upstream.Addr().String(), TCPReverseProxyConfig{
+		TLS:                 &tls.Config{},
+		TLSHandshakeTimeout: 100 * time.Millisecond,
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy(conn)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the upstream handshake did not time out")
+	}
+
+	if !errors.Is(dialErr, context.DeadlineExceeded) {
+		t.Errorf("dial failed with %v, want the handshake to time out", dialErr)
+	}
+}
@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// snapshotMap is a copy-on-write map. Readers load an immutable snapshot
+// without locking while writers serialize on mu and publish a new copy
+// with a single pointer swap.
+type snapshotMap[T any] struct {
+	mu   sync.Mutex
+	data atomic.Pointer[map[string]T]
+}
+
+func newSnapshotMap[T any]() *snapshotMap[T] {
+	m := &snapshotMap[T]{}
+	empty := make(map[string]T)
+	m.data.Store(&empty)
+	return m
+}
+
+// Load returns the current snapshot. It must not be modified.
+func (m *snapshotMap[T]) Load() map[string]T {
+	return *m.data.Load()
+}
+
+func (m *snapshotMap[T]) Get(key string) (T, bool) {
+	value, ok := m.Load()[key]
+	return value, ok
+}
+
+func (m *snapshotMap[T]) Set(key string, value T) {
+	m.Update(func(data map[string]T) {
+		data[key] = value
+	})
+}
+
+func (m *snapshotMap[T]) Delete(key string) {
+	m.Update(func(data map[string]T) {
+		delete(data, key)
+	})
+}
+
+// Update applies f to a private copy of the map and publishes the result,
+// so every change made by f becomes visible at once.
+func (m *snapshotMap[T]) Update(f func(data map[string]T)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := maps.Clone(m.Load())
+	f(data)
+	m.data.Store(&data)
+}
+
+func (m *snapshotMap[T]) Replace(data map[string]T) {
+	data = maps.Clone(data)
+	if data == nil {
+		data = make(map[string]T)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.Store(&data)
+}
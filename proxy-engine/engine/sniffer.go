@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultSniffTimeout = 3 * time.Second
+
+// Sniffer labels a raw connection with the protocol it speaks by peeking
+// at the start of the stream. Sniff must not consume anything and should
+// reject as soon as the bytes peeked so far rule the protocol out, as
+// every sniffer after it waits on it.
+type Sniffer interface {
+	Protocol() string
+	Sniff(conn BufferedConn) bool
+}
+
+type sniffer struct {
+	protocol string
+	sniff    func(conn BufferedConn) bool
+}
+
+func NewSniffer(protocol string, sniff func(conn BufferedConn) bool) Sniffer {
+	return &sniffer{
+		protocol: protocol,
+		sniff:    sniff,
+	}
+}
+
+func (s *sniffer) Protocol() string { return s.protocol }
+
+func (s *sniffer) Sniff(conn BufferedConn) bool { return s.sniff(conn) }
+
+// SnifferRegistry tries its sniffers in order until one claims the
+// connection. All of them share a single read deadline, so a client that
+// stalls is labelled by whatever it has sent when the deadline passes.
+type SnifferRegistry struct {
+	mu       sync.RWMutex
+	sniffers []Sniffer
+	timeout  time.Duration
+}
+
+func NewSnifferRegistry(timeout time.Duration, sniffers ...Sniffer) *SnifferRegistry {
+	return &SnifferRegistry{
+		sniffers: sniffers,
+		timeout:  timeout,
+	}
+}
+
+// Register replaces the sniffer for the same protocol, or adds the sniffer
+// ahead of every one already registered.
+func (r *SnifferRegistry) Register(s Sniffer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sniffers := make([]Sniffer, 0, len(r.sniffers)+1)
+	replaced := false
+	for _, existing := range r.sniffers {
+		if existing.Protocol() == s.Protocol() {
+			existing = s
+			replaced = true
+		}
+		sniffers = append(sniffers, existing)
+	}
+	if !replaced {
+		sniffers = append([]Sniffer{s}, sniffers...)
+	}
+
+	r.sniffers = sniffers
+}
+
+func (r *SnifferRegistry) SetTimeout(timeout time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timeout = timeout
+}
+
+// Sniff returns the protocol of the first sniffer to claim the
+// connection, or "" when none claims it. It only errors when the
+// connection fails before sending anything.
+func (r *SnifferRegistry) Sniff(conn BufferedConn) (string, error) {
+	return r.SniffWithServerFirst(conn, 0)
+}
+
+// SniffWithServerFirst is Sniff, but labels connections that send nothing
+// for serverFirstTimeout SniffServerFirst, as their clients are waiting
+// for the server to speak. It adds serverFirstTimeout to the time until
+// the upstream's greeting, and clients slower than it to send their first
+// bytes are mislabelled. Zero turns the label off, silent connections
+// then wait out the full sniff timeout and are labelled "".
+func (r *SnifferRegistry) SniffWithServerFirst(conn BufferedConn, serverFirstTimeout time.Duration) (string, error) {
+	r.mu.RLock()
+	sniffers := r.sniffers
+	timeout := r.timeout
+	r.mu.RUnlock()
+
+	start := time.Now()
+	defer conn.SetReadDeadline(time.Time{})
+
+	if serverFirstTimeout > 0 && serverFirstTimeout < timeout {
+		conn.SetReadDeadline(start.Add(serverFirstTimeout))
+		if _, err := conn.Peek(1); err != nil {
+			if !isTimeout(err) {
+				return "", err
+			}
+			return SniffServerFirst, nil
+		}
+	}
+
+	conn.SetReadDeadline(start.Add(timeout))
+
+	if _, err := conn.Peek(1); err != nil && !isTimeout(err) {
+		return "", err
+	}
+
+	for _, s := range sniffers {
+		if s.Sniff(conn) {
+			return s.Protocol(), nil
+		}
+	}
+
+	return "", nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// peekGrowing peeks at more and more of the stream until check has seen
+// enough to decide. check errors once the bytes can no longer match and
+// returns true once they do. Only bytes that have already arrived are
+// looked at before waiting on another one.
+func peekGrowing(reader *bufio.Reader, limit int, check func(data []byte) (bool, error)) error {
+	limit = min(limit, reader.Size())
+
+	n := max(min(reader.Buffered(), limit), 1)
+	for {
+		data, err := reader.Peek(n)
+
+		done, checkErr := check(data)
+		if checkErr != nil {
+			return checkErr
+		}
+		if done {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(data) >= limit {
+			return fmt.Errorf("Undecided after %d bytes", limit)
+		}
+
+		n = reader.Buffered()
+		if n <= len(data) {
+			n++
+		}
+		n = min(n, limit)
+	}
+}
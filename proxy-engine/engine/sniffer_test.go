@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSnifferRegistryServerFirst(t *testing.T) {
+	tests := []struct {
+		name               string
+		serverFirstTimeout time.Duration
+		send               string
+		want               string
+		// Upper bound on how long sniffing may take
+		within time.Duration
+	}{
+		{"silent", 50 * time.Millisecond, "", SniffServerFirst, 500 * time.Millisecond},
+		{"silent without fallback", 0, "", "", 2 * time.Second},
+		{"client first", 50 * time.Millisecond, "SSH-2.0-OpenSSH_9.6\r\n", SniffSSH, 500 * time.Millisecond},
+		{"http", 50 * time.Millisecond, "GET / HTTP/1.1\r\n", SniffHTTP1, 500 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := NewSnifferRegistry(time.Second, DefaultSniffers()...)
+
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			if test.send != "" {
+				go client.Write([]byte(test.send))
+			}
+
+			started := time.Now()
+			protocol, err := registry.SniffWithServerFirst(NewBufferedConn(server), test.serverFirstTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if protocol != test.want {
+				t.Errorf("sniffed %q, want %q", protocol, test.want)
+			}
+			if elapsed := time.Since(started); elapsed > test.within {
+				t.Errorf("sniffing took %s, want under %s", elapsed, test.within)
+			}
+		})
+	}
+}
+
+// TestServerSniffsLateClients has clients wait before sending anything,
+// entrypoints that did not ask for the server first label must still see
+// them as HTTP and TLS.
+func TestServerSniffsLateClients(t *testing.T) {
+	quietLog(t)
+
+	cert, key := newTestCert(t, "late.test", nil, nil, false)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	s := NewServer()
+	s.RegisterHTTPHandler("web", versionHandler(1))
+	s.RegisterTLSConfigHandler("web", TLSConfigHandlerFunc(func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{Certificates: []tls.Certificate{tlsCertificate(cert, key)}}, nil
+	}))
+	addr := startTestServer(t, s, "web")
+
+	const delay = 400 * time.Millisecond
+
+	t.Run("http", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		time.Sleep(delay)
+		assertLateRequest(t, conn)
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		t.Parallel()
+
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer raw.Close()
+		raw.SetDeadline(time.Now().Add(5 * time.Second))
+
+		time.Sleep(delay)
+		conn := tls.Client(raw, &tls.Config{ServerName: "late.test", RootCAs: roots})
+		if err := conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		assertLateRequest(t, conn)
+	})
+}
+
+func assertLateRequest(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: late.test\r\nConnection: close\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "v1" {
+		t.Errorf("late client got status %d body %q", res.StatusCode, body)
+	}
+}
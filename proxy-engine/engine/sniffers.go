@@ -0,0 +1,311 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// Protocols labelled by the default sniffers
+const (
+	SniffPROXY      = "proxy"
+	SniffTLS        = "tls"
+	SniffH2C        = "h2c"
+	SniffHTTP1      = "http"
+	SniffSSH        = "ssh"
+	SniffPostgreSQL = "postgresql"
+	SniffRedis      = "redis"
+	SniffMQTT       = "mqtt"
+	SniffMinecraft  = "minecraft"
+	// Connections that sent nothing within the server first timeout, see
+	// SnifferRegistry.SniffWithServerFirst
+	SniffServerFirst = "server-first"
+)
+
+const (
+	http2Preface       = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	proxyV1Signature   = "PROXY "
+	proxyV2Signature   = "\r\n\r\n\x00\r\nQUIT\n"
+	sniffMaxHeaderSize = 64
+)
+
+// DefaultSniffers returns the built in sniffers in the order they are
+// tried. Server first protocols such as MySQL, SMTP and FTP have no
+// sniffer, entrypoints serving them can have the registry label them
+// SniffServerFirst instead.
+func DefaultSniffers() []Sniffer {
+	return []Sniffer{
+		PROXYSniffer(),
+		TLSSniffer(),
+		H2CSniffer(),
+		HTTP1Sniffer(),
+		SSHSniffer(),
+		PostgreSQLSniffer(),
+		RedisSniffer(),
+		MQTTSniffer(),
+		MinecraftSniffer(),
+	}
+}
+
+// PrefixSniffer claims connections that open with any of the prefixes.
+func PrefixSniffer(protocol string, prefixes ...string) Sniffer {
+	limit := 0
+	for _, prefix := range prefixes {
+		limit = max(limit, len(prefix))
+	}
+
+	return NewSniffer(protocol, func(conn BufferedConn) bool {
+		return peekGrowing(conn.Reader(), limit, func(data []byte) (bool, error) {
+			return matchPrefix(data, prefixes...)
+		}) == nil
+	})
+}
+
+// PROXYSniffer recognises HAProxy PROXY protocol v1 and v2 headers.
+func PROXYSniffer() Sniffer {
+	return PrefixSniffer(SniffPROXY, proxyV1Signature, proxyV2Signature)
+}
+
+// TLSSniffer recognises a handshake record of any TLS version.
+func TLSSniffer() Sniffer {
+	return NewSniffer(SniffTLS, func(conn BufferedConn) bool {
+		return peekGrowing(conn.Reader(), 3, func(data []byte) (bool, error) {
+			switch {
+			case len(data) > 0 && data[0] != 0x16:
+				return false, fmt.Errorf("Not a handshake record")
+			case len(data) > 1 && data[1] != 0x03:
+				return false, fmt.Errorf("Unknown major version %d", data[1])
+			}
+			return len(data) >= 3, nil
+		}) == nil
+	})
+}
+
+// H2CSniffer recognises the connection preface of prior knowledge HTTP/2.
+func H2CSniffer() Sniffer {
+	return PrefixSniffer(SniffH2C, http2Preface)
+}
+
+// HTTP1Sniffer recognises an HTTP/1.x request line.
+func HTTP1Sniffer() Sniffer {
+	return NewSniffer(SniffHTTP1, func(conn BufferedConn) bool {
+		_, err := SniffHTTPRequestLine(conn)
+		return err == nil
+	})
+}
+
+// SSHSniffer recognises the identification string clients open with
+// (RFC 4253 section 4.2).
+func SSHSniffer() Sniffer {
+	return PrefixSniffer(SniffSSH, "SSH-")
+}
+
+// PostgreSQLSniffer recognises startup, SSL, GSSAPI and cancel requests.
+func PostgreSQLSniffer() Sniffer {
+	const (
+		cancelRequest = 80877102
+		sslRequest    = 80877103
+		gssEncRequest = 80877104
+		protocolMajor = 3
+	)
+
+	return NewSniffer(SniffPostgreSQL, func(conn BufferedConn) bool {
+		return peekGrowing(conn.Reader(), 8, func(data []byte) (bool, error) {
+			// Startup packets are far shorter than 16MB, so the length
+			// always opens with a zero byte
+			if len(data) > 0 && data[0] != 0 {
+				return false, fmt.Errorf("Startup packet too long")
+			}
+			if len(data) < 8 {
+				return false, nil
+			}
+
+			length := binary.BigEndian.Uint32(data[0:4])
+			code := binary.BigEndian.Uint32(data[4:8])
+			if length < 8 {
+				return false, fmt.Errorf("Startup packet too short")
+			}
+
+			switch code {
+			case cancelRequest, sslRequest, gssEncRequest:
+				return true, nil
+			}
+			if code>>16 != protocolMajor {
+				return false, fmt.Errorf("Unknown protocol version %d", code>>16)
+			}
+
+			return true, nil
+		}) == nil
+	})
+}
+
+// RedisSniffer recognises a command sent as a RESP array of bulk strings,
+// which every client library uses.
+func RedisSniffer() Sniffer {
+	return NewSniffer(SniffRedis, func(conn BufferedConn) bool {
+		return peekGrowing(conn.Reader(), sniffMaxHeaderSize, func(data []byte) (bool, error) {
+			if len(data) == 0 {
+				return false, nil
+			}
+			if data[0] != '*' {
+				return false, fmt.Errorf("Not a RESP array")
+			}
+
+			i := 1
+			for i < len(data) && data[i] >= '0' && data[i] <= '9' {
+				i++
+			}
+			if i == len(data) {
+				return false, nil
+			}
+			if i == 1 {
+				return false, fmt.Errorf("Missing array length")
+			}
+
+			done, err := matchPrefix(data[i:], "\r\n$")
+			if err != nil {
+				return false, fmt.Errorf("Not a RESP array of bulk strings")
+			}
+			return done, nil
+		}) == nil
+	})
+}
+
+// MQTTSniffer recognises the CONNECT packet of MQTT 3.1, 3.1.1 and 5.
+func MQTTSniffer() Sniffer {
+	const connectPacket = 0x10
+
+	return NewSniffer(SniffMQTT, func(conn BufferedConn) bool {
+		return peekGrowing(conn.Reader(), sniffMaxHeaderSize, func(data []byte) (bool, error) {
+			if len(data) == 0 {
+				return false, nil
+			}
+			if data[0] != connectPacket {
+				return false, fmt.Errorf("Not a CONNECT packet")
+			}
+
+			// Remaining length is a variable byte integer of at most 4
+			// bytes
+			i := 1
+			for ; i < len(data) && data[i]&0x80 != 0; i++ {
+				if i == 4 {
+					return false, fmt.Errorf("Malformed remaining length")
+				}
+			}
+			if i >= len(data) {
+				return false, nil
+			}
+			rest := data[i+1:]
+
+			var level []byte
+			switch {
+			case bytes.HasPrefix(rest, []byte("\x00\x04MQTT")):
+				level = []byte{4, 5}
+				rest = rest[6:]
+			case bytes.HasPrefix(rest, []byte("\x00\x06MQIsdp")):
+				level = []byte{3}
+				rest = rest[8:]
+			default:
+				_, err := matchPrefix(rest, "\x00\x04MQTT", "\x00\x06MQIsdp")
+				return false, err
+			}
+
+			if len(rest) == 0 {
+				return false, nil
+			}
+			if !slices.Contains(level, rest[0]) {
+				return false, fmt.Errorf("Unknown protocol level %d", rest[0])
+			}
+
+			return true, nil
+		}) == nil
+	})
+}
+
+// MinecraftSniffer recognises the handshake of Minecraft Java edition,
+// and the server list ping of clients older than 1.7.
+func MinecraftSniffer() Sniffer {
+	const (
+		legacyPing    = 0xFE
+		handshakeID   = 0x00
+		maxHandshake  = 4096
+		maxHostLength = 255 * 4
+	)
+
+	return NewSniffer(SniffMinecraft, func(conn BufferedConn) bool {
+		return peekGrowing(conn.Reader(), sniffMaxHeaderSize, func(data []byte) (bool, error) {
+			if len(data) > 0 && data[0] == legacyPing {
+				return matchPrefix(data, "\xFE\x01")
+			}
+
+			// Packet length, packet id, protocol version and the length
+			// of the server address, which are all that is needed to tell
+			var fields [4]int
+			var lengthSize int
+			offset := 0
+			for i := range fields {
+				value, n, complete, err := sniffVarInt(data[offset:])
+				if err != nil {
+					return false, err
+				}
+				if !complete {
+					return false, nil
+				}
+				fields[i] = value
+				offset += n
+				if i == 0 {
+					lengthSize = n
+				}
+			}
+
+			length, id, hostLength := fields[0], fields[1], fields[3]
+			switch {
+			case id != handshakeID:
+				return false, fmt.Errorf("Not a handshake packet")
+			case length > maxHandshake:
+				return false, fmt.Errorf("Handshake too long")
+			case hostLength == 0 || hostLength > maxHostLength:
+				return false, fmt.Errorf("Invalid server address length %d", hostLength)
+			// The address is followed by a two byte port and the next state
+			case length < offset-lengthSize+hostLength+3:
+				return false, fmt.Errorf("Handshake too short")
+			}
+
+			return true, nil
+		}) == nil
+	})
+}
+
+// matchPrefix reports whether data opens with one of the prefixes. It
+// errors once data has diverged from all of them.
+func matchPrefix(data []byte, prefixes ...string) (bool, error) {
+	partial := false
+	for _, prefix := range prefixes {
+		n := min(len(data), len(prefix))
+		if string(data[:n]) != prefix[:n] {
+			continue
+		}
+		if n == len(prefix) {
+			return true, nil
+		}
+		partial = true
+	}
+	if !partial {
+		return false, fmt.Errorf("No matching prefix")
+	}
+	return false, nil
+}
+
+// sniffVarInt decodes a VarInt, complete is false while data holds only
+// part of it.
+func sniffVarInt(data []byte) (value int, length int, complete bool, err error) {
+	value, length, err = decodeVarInt(data)
+	if err != nil {
+		if len(data) < 5 {
+			return 0, 0, false, nil
+		}
+		return 0, 0, false, err
+	}
+	return value, length, true, nil
+}
@@ -7,10 +7,21 @@ import (
 type TCPEntryPoint struct {
 	Identifier string
 	Address    string
+	// Accepts PROXY protocol headers from trusted load balancers when set
+	ProxyProtocol *ProxyProtocolConfig
 }
 
 func (e TCPEntryPoint) Listen() (net.Listener, error) {
-	return net.Listen("tcp", e.Address)
+	ln, err := net.Listen("tcp", e.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.ProxyProtocol != nil {
+		ln = newProxyProtocolListener(ln, *e.ProxyProtocol)
+	}
+
+	return ln, nil
 }
 
 func (e TCPEntryPoint) Id() string {
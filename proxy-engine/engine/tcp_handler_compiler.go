@@ -1,6 +1,11 @@
 package engine
 
-import "log"
+import (
+	"log"
+	"maps"
+	"slices"
+	"sync"
+)
 
 type TCPHandler interface {
 	ServeTCP(*BufferedTCPConn)
@@ -32,26 +37,46 @@ func (w *tcpHandlerWrapper) Rule() Rule {
 type TCPRoute struct {
 	Rule      Rule
 	ServiceId string
+	// Routes with a higher priority are matched first. Zero derives the
+	// priority from the rule, see RulePriority.
+	Priority int
+	// Terminate TLS with the entrypoint's TLSConfigHandler and pass the
+	// plaintext to the service. Such routes only match connections the
+	// proxy terminated, all others only match raw or passed through ones.
+	TerminateTLS bool
+}
+
+func (r *TCPRoute) priority() int {
+	if r.Priority != 0 {
+		return r.Priority
+	}
+	return RulePriority(r.Rule)
+}
+
+func (r *TCPRoute) match(ctx *TCPContext) bool {
+	return (ctx.TLS != nil) == r.TerminateTLS && r.Rule.Match(ctx)
 }
 
 type TCPRouter interface {
 	Match(*TCPContext) (string, *TCPRoute)
 	RegisterRoute(routeId string, route *TCPRoute) TCPRouter
 	DeregisterRoute(routeId string)
-	Routes() []*TCPRoute
+	Routes() map[string]*TCPRoute
 }
 
 type tcpRouter struct {
+	mu     sync.RWMutex
 	routes map[string]*TCPRoute
 }
 
 func NewTCPRouter() TCPRouter {
 	return &tcpRouter{
-		make(map[string]*TCPRoute),
+		routes: make(map[string]*TCPRoute),
 	}
 }
 
 type TCPHandlerCompiler struct {
+	mu       sync.RWMutex
 	routers  map[string]TCPRouter
 	services map[string]TCPServiceFunc
 }
@@ -64,25 +89,35 @@ func NewTCPHandlerCompiler() *TCPHandlerCompiler {
 }
 
 func (c *TCPHandlerCompiler) RegisterService(serviceId string, service func(conn *BufferedTCPConn)) *TCPHandlerCompiler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.services[serviceId] = service
 	return c
 }
 
 func (c *TCPHandlerCompiler) DeregisterService(serviceId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	delete(c.services, serviceId)
 }
 
 func (c *TCPHandlerCompiler) RegisterRouter(routerId string) TCPRouter {
 	router := NewTCPRouter()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.routers[routerId] = router
 	return router
 }
 
 func (c *TCPHandlerCompiler) DeregisterRouter(routerId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	delete(c.routers, routerId)
 }
 
 func (c *TCPHandlerCompiler) Router(routerId string) TCPRouter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if router, ok := c.routers[routerId]; ok {
 		return router
 	}
@@ -90,8 +125,11 @@ func (c *TCPHandlerCompiler) Router(routerId string) TCPRouter {
 }
 
 func (r *tcpRouter) Match(ctx *TCPContext) (string, *TCPRoute) {
-	for id, route := range r.routes {
-		if route.Rule.Match(ctx) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, id := range orderRoutes(r.routes) {
+		if route := r.routes[id]; route.match(ctx) {
 			return id, route
 		}
 	}
@@ -99,90 +137,100 @@ func (r *tcpRouter) Match(ctx *TCPContext) (string, *TCPRoute) {
 }
 
 func (r *tcpRouter) RegisterRoute(routeId string, route *TCPRoute) TCPRouter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.routes[routeId] = route
 	return r
 }
 
 func (r *tcpRouter) DeregisterRoute(routeId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	delete(r.routes, routeId)
 }
 
+func (r *tcpRouter) Routes() map[string]*TCPRoute {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return maps.Clone(r.routes)
+}
+
+type compiledTCPRoute struct {
+	routerId string
+	routeId  string
+	route    *TCPRoute
+	service  TCPServiceFunc
+}
+
+// Compile snapshots the given routers and the services they point at into
+// an immutable handler. Later registrations only take effect once the
+// handler is compiled and registered again.
 func (c *TCPHandlerCompiler) Compile(routerIds ...string) TCPHandler {
-	type routerWrapper struct {
-		Router TCPRouter
-		Id     string
-	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	var routers []routerWrapper
-	var rules []Rule
+	var table []compiledTCPRoute
 
-	for _, id := range routerIds {
-		router, ok := c.routers[id]
+	for _, routerId := range routerIds {
+		router, ok := c.routers[routerId]
 		if !ok {
 			continue
 		}
 
-		routers = append(routers, routerWrapper{
-			Router: router,
-			Id:     id,
-		})
-
-		for _, route := range router.Routes() {
-			rules = append(rules, route.Rule)
+		routes := router.Routes()
+		for _, routeId := range orderRoutes(routes) {
+			route := routes[routeId]
+			table = append(table, compiledTCPRoute{
+				routerId: routerId,
+				routeId:  routeId,
+				route:    route,
+				service:  c.services[route.ServiceId],
+			})
 		}
 	}
 
-	return TCPHandlerFunc(func(conn *BufferedTCPConn) {
-		var route *TCPRoute
-		var routerId string
-		var routeId string
-
-		ctx := NewTCPContext(conn)
-
-		for _, rw := range routers {
-			id, r := rw.Router.Match(ctx)
-			if r != nil {
-				route = r
-				routeId = id
-				routerId = rw.Id
-				break
+	slices.SortStableFunc(table, func(a, b compiledTCPRoute) int {
+		return compareRoutes(a.routeId, a.route, b.routeId, b.route)
+	})
+
+	find := func(ctx *TCPContext) *compiledTCPRoute {
+		for i := range table {
+			if table[i].route.match(ctx) {
+				return &table[i]
 			}
 		}
+		return nil
+	}
+
+	return TCPHandlerFunc(func(conn *BufferedTCPConn) {
+		match := find(NewTCPContext(conn))
 
-		if route == nil {
+		if match == nil {
 			return
 		}
 
 		log.Printf(
 			"%s | TCP router \"%s\" routing request to \"%s\"\n",
 			conn.RemoteAddr(),
-			routerId,
-			routeId,
+			match.routerId,
+			match.routeId,
 		)
 
-		service, ok := c.services[route.ServiceId]
-
-		if !ok {
+		if match.service == nil {
 			return
 		}
 
 		log.Printf(
 			"%s | \"%s\" serving \"%s\" service",
 			conn.RemoteAddr(),
-			routeId,
-			route.ServiceId,
+			match.routeId,
+			match.route.ServiceId,
 		)
 
-		service(conn)
+		match.service(conn)
 
 		conn.Close()
-	}, Or(rules...))
-}
-
-func (r *tcpRouter) Routes() []*TCPRoute {
-	var routes []*TCPRoute
-	for _, route := range r.routes {
-		routes = append(routes, route)
-	}
-	return routes
+	}, TCPRuleFunc(func(ctx *TCPContext) bool {
+		return find(ctx) != nil
+	}))
 }
@@ -5,62 +5,32 @@ import (
 	"fmt"
 )
 
-type TCPRuntime struct {
-	handlers map[string]TCPHandler
-}
+type TCPRuntime struct{}
 
 func NewTCPRuntime() *TCPRuntime {
-	return &TCPRuntime{
-		make(map[string]TCPHandler),
-	}
+	return &TCPRuntime{}
 }
 
-func (r *TCPRuntime) Claim(e string, ctx *TCPContext) bool {
-	handler, present := r.handlers[e]
-	if !present {
+// Claim reports whether handler, the entrypoint's TCP handler looked up
+// once for the connection, wants it. handler may be nil.
+func (r *TCPRuntime) Claim(handler TCPHandler, ctx *TCPContext) bool {
+	if handler == nil {
 		return false
 	}
 	return handler.Rule().Match(ctx)
 }
 
-func (r *TCPRuntime) Handle(ctx context.Context, e string, bconn BufferedConn) error {
+func (r *TCPRuntime) Handle(ctx context.Context, handler TCPHandler, bconn BufferedConn) error {
 	conn, err := NewBufferedTCPConn(bconn)
 	if err != nil {
-		conn.Close()
+		bconn.Close()
 		return fmt.Errorf("Failed to create TCP connection object. Is the transport protcol not TCP?")
 	}
+	conn.ctx = ctx
 
-	handler, ok := r.handlers[e]
-	if !ok {
-		conn.Close()
-		return fmt.Errorf("No handlers registered for this entrypoint")
-	}
-
-	done := make(chan struct{})
-
-	go func() {
-		defer close(done)
-		handler.ServeTCP(conn)
-	}()
-
-	select {
-	case <-ctx.Done():
-		conn.Close()
-		return fmt.Errorf("Context is done")
-	case <-done:
-		return nil
-	}
-}
-
-func (r *TCPRuntime) RegisterHandler(entryPointId string, handler TCPHandler) {
-	r.handlers[entryPointId] = handler
-}
-
-func (r *TCPRuntime) DeregisterHandler(entryPointId string) {
-	delete(r.handlers, entryPointId)
-}
+	// Raw streams have no point where they can be stopped gracefully, so a
+	// draining connection keeps proxying until the server force closes it.
+	handler.ServeTCP(conn)
 
-func (r *TCPRuntime) IsHandlerRegistered(entryPointId string) bool {
-	_, present := r.handlers[entryPointId]
-	return present
+	return nil
 }
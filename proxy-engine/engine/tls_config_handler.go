@@ -1,6 +1,9 @@
 package engine
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"slices"
+)
 
 type TLSConfigHandler interface {
 	HandleTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error)
@@ -11,3 +14,29 @@ type TLSConfigHandlerFunc func(info *tls.ClientHelloInfo) (*tls.Config, error)
 func (f TLSConfigHandlerFunc) HandleTLSConfig(info *tls.ClientHelloInfo) (*tls.Config, error) {
 	return f(info)
 }
+
+// ServerNameMatcher is implemented by TLSConfigHandlers that can tell the
+// server names they hold a certificate for apart from those they only
+// answer with a default.
+type ServerNameMatcher interface {
+	MatchesServerName(serverName string) bool
+}
+
+// negotiableALPN drops the config's protocols when the client offers none
+// of them. The handshake then completes without ALPN instead of failing,
+// so TCP routes can terminate protocols such as mqtt.
+func negotiableALPN(config *tls.Config, offered []string) *tls.Config {
+	if len(config.NextProtos) == 0 || len(offered) == 0 {
+		return config
+	}
+
+	for _, protocol := range offered {
+		if slices.Contains(config.NextProtos, protocol) {
+			return config
+		}
+	}
+
+	config = config.Clone()
+	config.NextProtos = nil
+	return config
+}
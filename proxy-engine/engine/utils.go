@@ -3,6 +3,7 @@ package engine
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
@@ -30,6 +31,9 @@ func (pc *peekConn) SetWriteDeadline(t time.Time) error { return nil }
 func PeekTLSClientHelloInfo(conn BufferedConn) (*tls.ClientHelloInfo, error) {
 	const tlsRecordHeaderLen = 5
 	peekedHeader, err := conn.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return nil, err
+	}
 
 	if peekedHeader[0] != 0x16 {
 		return nil, fmt.Errorf("not a TLS handshake record (%x)", peekedHeader[0])
@@ -84,7 +88,23 @@ type TCPContext struct {
 	RemoteIP    string
 	ClaimedPort string
 	ProtoType   string
-	Peek        func(n int) ([]byte, error)
+	// Label the sniffers gave the connection, "" when none recognised it
+	Protocol string
+	Peek     func(n int) ([]byte, error)
+	// Protocols offered in the ClientHello. Once the proxy has terminated
+	// the connection's TLS only the negotiated one, if there is one.
+	ALPN []string
+	// Set once the proxy has terminated the connection's TLS
+	TLS *tls.ConnectionState
+	// Header the connection was accepted with from a trusted load
+	// balancer, ClientAddr is already the client it names
+	Proxy *ProxyHeader
+}
+
+// ClientCert returns the verified client certificate, or nil when the
+// client did not present one or it was not verified against a CA.
+func (t *TCPContext) ClientCert() *x509.Certificate {
+	return verifiedClientCert(t.TLS)
 }
 
 func NewTCPContext(conn BufferedConn) *TCPContext {
@@ -93,6 +113,8 @@ func NewTCPContext(conn BufferedConn) *TCPContext {
 		ClientAddr: conn.RemoteAddr(),
 		RemoteAddr: conn.RemoteAddr(),
 		ProtoType:  "TCP",
+		Protocol:   conn.Protocol(),
+		Proxy:      ProxyHeaderOf(conn),
 		Peek:       conn.Reader().Peek,
 	}
 
@@ -119,11 +141,28 @@ func NewTCPContext(conn BufferedConn) *TCPContext {
 		}
 	}
 
+	// The stream of a terminated connection is plaintext, the handshake
+	// has already been read
+	if tcpConn, ok := conn.(*BufferedTCPConn); ok && tcpConn.TLS() != nil {
+		ctx.ProtoType = "TLS"
+		ctx.SNI = tcpConn.TLS().ServerName
+		ctx.TLS = tcpConn.TLS()
+		ctx.ALPN = tcpConn.ALPN()
+		return &ctx
+	}
+
+	// Only a connection sniffed as TLS is worth peeking a ClientHello
+	// from, anything else may never send the bytes to fill one
+	if ctx.Protocol != SniffTLS {
+		return &ctx
+	}
+
 	state, err := PeekTLSClientHelloInfo(conn)
 
 	if err == nil {
 		ctx.ProtoType = "TLS"
 		ctx.SNI = state.ServerName
+		ctx.ALPN = state.SupportedProtos
 	}
 
 	return &ctx
@@ -1,3 +1,14 @@
 module github.com/aidanhopper/reverse-proxy/proxy-engine
 
 go 1.25.1
+
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	golang.org/x/crypto v0.55.0
+	golang.org/x/net v0.57.0
+)
+
+require (
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
+)
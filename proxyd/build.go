@@ -0,0 +1,869 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aidanhopper/reverse-proxy/proxy-engine/engine"
+)
+
+var builtinMiddlewares = map[string]func() engine.Middleware{
+	"require-secure":         engine.RequireSecure,
+	"set-forwarding-headers": engine.SetForwardingHeaders,
+	"forward-client-cert":    engine.ForwardClientCert,
+}
+
+func buildMiddleware(config HTTPConfig, names []string) (engine.Middleware, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var mws []engine.Middleware
+	for _, name := range names {
+		mw, err := resolveMiddleware(config, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		mws = append(mws, mw)
+	}
+
+	if len(mws) == 1 {
+		return mws[0], nil
+	}
+	return engine.Chain(mws...), nil
+}
+
+func resolveMiddleware(config HTTPConfig, name string, visiting []string) (engine.Middleware, error) {
+	if slices.Contains(visiting, name) {
+		return nil, fmt.Errorf(
+			"middleware \"%s\" references itself through %s",
+			name,
+			strings.Join(append(visiting, name), " -> "),
+		)
+	}
+
+	if builtin, ok := builtinMiddlewares[name]; ok {
+		return builtin(), nil
+	}
+
+	def, ok := config.MiddlewareDefinitions[name]
+	if !ok {
+		return nil, fmt.Errorf("middleware \"%s\" is not defined", name)
+	}
+
+	switch {
+	case def.StripPrefix != "":
+		return engine.StripPrefix(def.StripPrefix), nil
+	case def.Logging != "":
+		return engine.Logging(def.Logging), nil
+	case len(def.Chain) > 0:
+		var mws []engine.Middleware
+		for _, next := range def.Chain {
+			mw, err := resolveMiddleware(config, next, append(visiting, name))
+			if err != nil {
+				return nil, err
+			}
+			mws = append(mws, mw)
+		}
+		return engine.Chain(mws...), nil
+	}
+
+	return nil, fmt.Errorf("middleware \"%s\" has no type", name)
+}
+
+// referencedMiddlewares collects every middleware definition names
+// depend on, following chains. Routes are rebuilt when any of them change.
+func referencedMiddlewares(config HTTPConfig, names []string) map[string]MiddlewareConfig {
+	refs := make(map[string]MiddlewareConfig)
+
+	var visit func(name string)
+	visit = func(name string) {
+		def, ok := config.MiddlewareDefinitions[name]
+		if !ok {
+			return
+		}
+		if _, seen := refs[name]; seen {
+			return
+		}
+		refs[name] = def
+		for _, next := range def.Chain {
+			visit(next)
+		}
+	}
+
+	for _, name := range names {
+		visit(name)
+	}
+
+	return refs
+}
+
+func buildEntrypoint(id string, config EntrypointConfig) (engine.TCPEntryPoint, error) {
+	entrypoint := engine.TCPEntryPoint{
+		Identifier: id,
+		Address:    config.Address,
+	}
+
+	if config.ProxyProtocol == nil {
+		return entrypoint, nil
+	}
+
+	proxyProtocol := &engine.ProxyProtocolConfig{}
+	for _, cidr := range config.ProxyProtocol.Trusted {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return engine.TCPEntryPoint{}, fmt.Errorf("invalid trusted cidr \"%s\"", cidr)
+		}
+		proxyProtocol.Trusted = append(proxyProtocol.Trusted, prefix.Masked())
+	}
+
+	if config.ProxyProtocol.Timeout != "" {
+		timeout, err := time.ParseDuration(config.ProxyProtocol.Timeout)
+		if err != nil || timeout <= 0 {
+			return engine.TCPEntryPoint{}, fmt.Errorf("invalid proxy-protocol timeout \"%s\"", config.ProxyProtocol.Timeout)
+		}
+		proxyProtocol.Timeout = timeout
+	}
+
+	entrypoint.ProxyProtocol = proxyProtocol
+
+	return entrypoint, nil
+}
+
+func buildServerFirstTimeout(config EntrypointConfig) (time.Duration, error) {
+	if config.ServerFirstTimeout == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(config.ServerFirstTimeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid server-first-timeout \"%s\"", config.ServerFirstTimeout)
+	}
+	return timeout, nil
+}
+
+func buildHTTPRoute(config HTTPConfig, route HTTPRouteConfig) (*engine.HTTPRoute, error) {
+	rule, err := engine.ParseHTTPRule(route.Rule)
+	if err != nil {
+		return nil, err
+	}
+
+	middleware, err := buildMiddleware(config, route.Middlewares)
+	if err != nil {
+		return nil, err
+	}
+
+	return &engine.HTTPRoute{
+		Rule:       rule,
+		Middleware: middleware,
+		ServiceId:  route.Service,
+		Priority:   route.Priority,
+	}, nil
+}
+
+func buildTCPRoute(route TCPRouteConfig) (*engine.TCPRoute, error) {
+	rule, err := engine.ParseTCPRule(route.Rule)
+	if err != nil {
+		return nil, err
+	}
+
+	return &engine.TCPRoute{
+		Rule:         rule,
+		ServiceId:    route.Service,
+		Priority:     route.Priority,
+		TerminateTLS: route.TLS != "",
+	}, nil
+}
+
+// upstreamURL lets services be written as a bare host:port, which is
+// https when the service sets tls.
+func upstreamURL(address string, secure bool) string {
+	if strings.Contains(address, "://") {
+		return address
+	}
+	if secure {
+		return "https://" + address
+	}
+	return "http://" + address
+}
+
+func buildBalancer(method string) (engine.Balancer, error) {
+	balancer, err := engine.NewBalancer(engine.BalancerMethod(method))
+	if err != nil {
+		return nil, fmt.Errorf("unknown load balancer method \"%s\"", method)
+	}
+	return balancer, nil
+}
+
+func checkWeight(weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	return nil
+}
+
+// buildHTTPService adds the health checkers of the service's load
+// balancers to checkers, they are left for the caller to start and close.
+// A nil checkers discards them.
+func buildHTTPService(service HTTPServiceConfig, checkers *[]*engine.HealthChecker) (http.Handler, error) {
+	var kinds []string
+	if service.ReverseProxy != "" {
+		kinds = append(kinds, "reverse-proxy")
+	}
+	if service.LoadBalancer != nil {
+		kinds = append(kinds, "load-balancer")
+	}
+	if service.FileServer != "" {
+		kinds = append(kinds, "file-server")
+	}
+	if service.Redirect != "" {
+		kinds = append(kinds, "redirect")
+	}
+
+	if len(kinds) != 1 {
+		return nil, fmt.Errorf(
+			"exactly one of reverse-proxy, load-balancer, file-server or redirect must be set, found [%s]",
+			strings.Join(kinds, ", "),
+		)
+	}
+
+	if service.ProxyProtocol != nil && service.ReverseProxy == "" {
+		return nil, fmt.Errorf("proxy-protocol can only be set on a reverse-proxy")
+	}
+
+	if service.Transport != nil && service.ReverseProxy == "" {
+		return nil, fmt.Errorf("transport can only be set on a reverse-proxy")
+	}
+
+	if service.TLS != nil && service.ReverseProxy == "" {
+		return nil, fmt.Errorf("tls can only be set on a reverse-proxy")
+	}
+
+	switch {
+	case service.ReverseProxy != "":
+		proxyProtocol, err := buildUpstreamProxyProtocol(service.ProxyProtocol)
+		if err != nil {
+			return nil, err
+		}
+		transport, err := buildHTTPTransport(service.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("transport: %w", err)
+		}
+		tlsConfig, err := buildUpstreamTLS(service.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		address := upstreamURL(service.ReverseProxy, service.TLS != nil)
+		proxy, err := engine.NewHTTPReverseProxy(address, engine.HTTPReverseProxyConfig{
+			ProxyProtocol: proxyProtocol,
+			Transport:     transport,
+			TLS:           tlsConfig,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid reverse-proxy \"%s\": %w", service.ReverseProxy, err)
+		}
+		return proxy, nil
+	case service.FileServer != "":
+		return engine.FileServer(service.FileServer), nil
+	case service.Redirect != "":
+		return engine.Redirect(service.Redirect), nil
+	}
+
+	lb := service.LoadBalancer
+	balancer, err := buildBalancer(lb.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lb.Services) == 0 {
+		return nil, fmt.Errorf("load-balancer has no services")
+	}
+
+	healthCheck, err := buildHealthCheck(lb.HealthCheck, "http")
+	if err != nil {
+		return nil, fmt.Errorf("health-check: %w", err)
+	}
+
+	outlierDetection, err := buildOutlierDetection(lb.OutlierDetection)
+	if err != nil {
+		return nil, fmt.Errorf("outlier-detection: %w", err)
+	}
+
+	var members []engine.LoadBalancerMember[http.Handler]
+	addMembers := func(services []HTTPServiceConfig, backup bool, kind string) error {
+		for i, member := range services {
+			if err := checkWeight(member.Weight); err != nil {
+				return fmt.Errorf("load-balancer %s %d: %w", kind, i, err)
+			}
+			handler, err := buildHTTPService(member, checkers)
+			if err != nil {
+				return fmt.Errorf("load-balancer %s %d: %w", kind, i, err)
+			}
+
+			var checker *engine.HealthChecker
+			if healthCheck != nil && member.ReverseProxy != "" {
+				upstream, err := url.Parse(upstreamURL(member.ReverseProxy, member.TLS != nil))
+				if err != nil {
+					return fmt.Errorf("load-balancer %s %d: invalid reverse-proxy \"%s\"", kind, i, member.ReverseProxy)
+				}
+				tlsConfig, err := buildUpstreamTLS(member.TLS)
+				if err != nil {
+					return fmt.Errorf("load-balancer %s %d: tls: %w", kind, i, err)
+				}
+				checker = healthCheck.checker(upstream, tlsConfig)
+				collectHealthChecker(checkers, checker)
+			}
+
+			members = append(members, engine.LoadBalancerMember[http.Handler]{
+				Service: handler,
+				Name:    member.ReverseProxy,
+				Weight:  member.Weight,
+				Health:  checker,
+				Backup:  backup,
+			})
+		}
+		return nil
+	}
+
+	if err := addMembers(lb.Services, false, "service"); err != nil {
+		return nil, err
+	}
+	if err := addMembers(lb.Backup, true, "backup"); err != nil {
+		return nil, err
+	}
+
+	return engine.NewHTTPLoadBalancer(engine.LoadBalancerConfig{
+		Balancer:         balancer,
+		OutlierDetection: outlierDetection,
+	}, members...), nil
+}
+
+func buildTCPService(service TCPServiceConfig, checkers *[]*engine.HealthChecker) (engine.TCPServiceFunc, error) {
+	if (service.ReverseProxy != "") == (service.LoadBalancer != nil) {
+		return nil, fmt.Errorf("exactly one of reverse-proxy or load-balancer must be set")
+	}
+
+	if service.TLS != nil && service.ReverseProxy == "" {
+		return nil, fmt.Errorf("tls can only be set on a reverse-proxy")
+	}
+
+	if service.ProxyProtocol != nil && service.ReverseProxy == "" {
+		return nil, fmt.Errorf("proxy-protocol can only be set on a reverse-proxy")
+	}
+
+	if service.ReverseProxy != "" {
+		proxyProtocol, err := buildUpstreamProxyProtocol(service.ProxyProtocol)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig, err := buildUpstreamTLS(service.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+
+		return engine.NewTCPReverseProxy(service.ReverseProxy, engine.TCPReverseProxyConfig{
+			TLS:           tlsConfig,
+			ProxyProtocol: proxyProtocol,
+		}), nil
+	}
+
+	lb := service.LoadBalancer
+	balancer, err := buildBalancer(lb.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lb.Services) == 0 {
+		return nil, fmt.Errorf("load-balancer has no services")
+	}
+
+	healthCheck, err := buildHealthCheck(lb.HealthCheck, "tcp")
+	if err != nil {
+		return nil, fmt.Errorf("health-check: %w", err)
+	}
+
+	outlierDetection, err := buildOutlierDetection(lb.OutlierDetection)
+	if err != nil {
+		return nil, fmt.Errorf("outlier-detection: %w", err)
+	}
+
+	var members []engine.LoadBalancerMember[engine.TCPServiceFunc]
+	addMembers := func(services []TCPServiceConfig, backup bool, kind string) error {
+		for i, member := range services {
+			if err := checkWeight(member.Weight); err != nil {
+				return fmt.Errorf("load-balancer %s %d: %w", kind, i, err)
+			}
+			service, err := buildTCPService(member, checkers)
+			if err != nil {
+				return fmt.Errorf("load-balancer %s %d: %w", kind, i, err)
+			}
+
+			var checker *engine.HealthChecker
+			if healthCheck != nil && member.ReverseProxy != "" {
+				tlsConfig, err := buildUpstreamTLS(member.TLS)
+				if err != nil {
+					return fmt.Errorf("load-balancer %s %d: tls: %w", kind, i, err)
+				}
+				upstream := &url.URL{Scheme: "http", Host: member.ReverseProxy}
+				if tlsConfig != nil {
+					upstream.Scheme = "https"
+				}
+				checker = healthCheck.checker(upstream, tlsConfig)
+				collectHealthChecker(checkers, checker)
+			}
+
+			members = append(members, engine.LoadBalancerMember[engine.TCPServiceFunc]{
+				Service: service,
+				Name:    member.ReverseProxy,
+				Weight:  member.Weight,
+				Health:  checker,
+				Backup:  backup,
+			})
+		}
+		return nil
+	}
+
+	if err := addMembers(lb.Services, false, "service"); err != nil {
+		return nil, err
+	}
+	if err := addMembers(lb.Backup, true, "backup"); err != nil {
+		return nil, err
+	}
+
+	return engine.NewTCPLoadBalancer(engine.LoadBalancerConfig{
+		Balancer:         balancer,
+		OutlierDetection: outlierDetection,
+	}, members...), nil
+}
+
+// healthCheck is a load balancer's health-check, ready to be made into a
+// checker for each of its reverse-proxy members.
+type healthCheck struct {
+	kind   string
+	path   *url.URL
+	status int
+	body   *regexp.Regexp
+	config engine.HealthCheckConfig
+}
+
+func buildHealthCheck(config *HealthCheckConfig, defaultKind string) (*healthCheck, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	check := &healthCheck{
+		kind:   config.Type,
+		status: config.Status,
+		config: engine.HealthCheckConfig{
+			Rise: config.Rise,
+			Fall: config.Fall,
+		},
+	}
+	if check.kind == "" {
+		check.kind = defaultKind
+	}
+
+	switch check.kind {
+	case "http":
+		path := config.Path
+		if path == "" {
+			path = "/"
+		}
+		ref, err := url.Parse(path)
+		if err != nil || !strings.HasPrefix(path, "/") || ref.Host != "" {
+			return nil, fmt.Errorf("path must start with /")
+		}
+		check.path = ref
+		if check.status != 0 && (check.status < 100 || check.status > 599) {
+			return nil, fmt.Errorf("invalid status %d", check.status)
+		}
+		if config.Body != "" {
+			body, err := regexp.Compile(config.Body)
+			if err != nil {
+				return nil, fmt.Errorf("invalid body pattern: %w", err)
+			}
+			check.body = body
+		}
+	case "tcp", "minecraft":
+		if config.Path != "" || config.Status != 0 || config.Body != "" {
+			return nil, fmt.Errorf("path, status and body only apply to http checks")
+		}
+	default:
+		return nil, fmt.Errorf("unknown type \"%s\"", check.kind)
+	}
+
+	if config.Rise < 0 || config.Fall < 0 {
+		return nil, fmt.Errorf("rise and fall must not be negative")
+	}
+
+	if config.Interval != "" {
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid interval \"%s\"", config.Interval)
+		}
+		check.config.Interval = interval
+	}
+
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout \"%s\"", config.Timeout)
+		}
+		check.config.Timeout = timeout
+	}
+
+	return check, nil
+}
+
+// checker makes the checker for a member at upstream, tlsConfig being the
+// TLS the member's reverse-proxy uses.
+func (h *healthCheck) checker(upstream *url.URL, tlsConfig *tls.Config) *engine.HealthChecker {
+	address := upstream.Host
+	if upstream.Port() == "" {
+		port := "80"
+		if upstream.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(upstream.Hostname(), port)
+	}
+
+	config := h.config
+	config.Name = address
+
+	switch h.kind {
+	case "http":
+		config.Probe = engine.HTTPHealthProbe(engine.HTTPHealthProbeConfig{
+			URL:    upstream.ResolveReference(h.path).String(),
+			Status: h.status,
+			Body:   h.body,
+			TLS:    tlsConfig,
+		})
+	case "tcp":
+		config.Probe = engine.TCPHealthProbe(address)
+	case "minecraft":
+		config.Probe = engine.MinecraftHealthProbe(address)
+	}
+
+	return engine.NewHealthChecker(config)
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func buildUpstreamTLS(config *UpstreamTLSConfig) (*tls.Config, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CA != "" {
+		pool, err := loadCertPool(config.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config.Certificate == "") != (config.Key == "") {
+		return nil, fmt.Errorf("certificate and key must be set together")
+	}
+	if config.Certificate != "" {
+		cert, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min-version \"%s\", expected 1.0, 1.1, 1.2 or 1.3", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	return tlsConfig, nil
+}
+
+func buildHTTPTransport(config *HTTPTransportConfig) (engine.HTTPTransportConfig, error) {
+	if config == nil {
+		return engine.HTTPTransportConfig{}, nil
+	}
+
+	if config.MaxIdleConns < 0 || config.MaxIdleConnsPerHost < 0 {
+		return engine.HTTPTransportConfig{}, fmt.Errorf("max-idle-conns and max-idle-conns-per-host must not be negative")
+	}
+
+	transport := engine.HTTPTransportConfig{
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		HTTP2:               config.HTTP2,
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"idle-conn-timeout", config.IdleConnTimeout, &transport.IdleConnTimeout},
+		{"dial-timeout", config.DialTimeout, &transport.DialTimeout},
+		{"response-header-timeout", config.ResponseHeaderTimeout, &transport.ResponseHeaderTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil || duration <= 0 {
+			return engine.HTTPTransportConfig{}, fmt.Errorf("invalid %s \"%s\"", d.name, d.value)
+		}
+		*d.field = duration
+	}
+
+	switch config.KeepAlive {
+	case "":
+	case "off":
+		transport.KeepAlive = -1
+	default:
+		keepAlive, err := time.ParseDuration(config.KeepAlive)
+		if err != nil || keepAlive <= 0 {
+			return engine.HTTPTransportConfig{}, fmt.Errorf("invalid keep-alive \"%s\"", config.KeepAlive)
+		}
+		transport.KeepAlive = keepAlive
+	}
+
+	return transport, nil
+}
+
+func buildOutlierDetection(config *OutlierDetectionConfig) (*engine.OutlierDetection, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	if config.ConsecutiveFailures < 0 || config.MinimumRequests < 0 {
+		return nil, fmt.Errorf("consecutive-failures and minimum-requests must not be negative")
+	}
+	if config.FailurePercent < 0 || config.FailurePercent > 100 {
+		return nil, fmt.Errorf("failure-percent must be between 0 and 100")
+	}
+	if config.MaxEjectionPercent < 0 || config.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("max-ejection-percent must be between 0 and 100")
+	}
+
+	detection := &engine.OutlierDetection{
+		ConsecutiveFailures: config.ConsecutiveFailures,
+		FailurePercent:      config.FailurePercent,
+		MinimumRequests:     config.MinimumRequests,
+		MaxEjectionPercent:  config.MaxEjectionPercent,
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"interval", config.Interval, &detection.Interval},
+		{"base-ejection-time", config.BaseEjectionTime, &detection.BaseEjectionTime},
+		{"max-ejection-time", config.MaxEjectionTime, &detection.MaxEjectionTime},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid %s \"%s\"", d.name, d.value)
+		}
+		*d.field = duration
+	}
+
+	return detection, nil
+}
+
+func collectHealthChecker(checkers *[]*engine.HealthChecker, checker *engine.HealthChecker) {
+	if checkers != nil {
+		*checkers = append(*checkers, checker)
+	}
+}
+
+func buildUpstreamProxyProtocol(config *UpstreamProxyProtocolConfig) (*engine.UpstreamProxyProtocol, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	if config.Version != 1 && config.Version != 2 {
+		return nil, fmt.Errorf("proxy-protocol version must be 1 or 2")
+	}
+
+	if len(config.TLVs) > 0 && config.Version != 2 {
+		return nil, fmt.Errorf("proxy-protocol tlvs need version 2")
+	}
+
+	proxyProtocol := &engine.UpstreamProxyProtocol{Version: config.Version}
+	for _, name := range config.TLVs {
+		switch name {
+		case "sni":
+			proxyProtocol.TLVs = append(proxyProtocol.TLVs, engine.ProxyTLVAuthority)
+		case "alpn":
+			proxyProtocol.TLVs = append(proxyProtocol.TLVs, engine.ProxyTLVALPN)
+		default:
+			return nil, fmt.Errorf("unknown proxy-protocol tlv \"%s\"", name)
+		}
+	}
+
+	return proxyProtocol, nil
+}
+
+func buildTLSResolver(resolver TLSResolverConfig) (engine.TLSConfigHandler, error) {
+	if resolver.ACME != nil {
+		return buildACMEResolver(*resolver.ACME)
+	}
+
+	if resolver.Directory != "" {
+		return engine.NewCertStore(engine.CertStoreConfig{
+			Dir:     resolver.Directory,
+			Default: resolver.Default,
+		})
+	}
+
+	cert, err := tls.LoadX509KeyPair(resolver.Certificate, resolver.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return staticCertificate{cert: cert}, nil
+}
+
+// staticCertificate answers every server name with one certificate.
+type staticCertificate struct {
+	cert tls.Certificate
+}
+
+func (s staticCertificate) HandleTLSConfig(info *tls.ClientHelloInfo) (*tls.Config, error) {
+	return &tls.Config{
+		Certificates: []tls.Certificate{s.cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, nil
+}
+
+func (s staticCertificate) MatchesServerName(serverName string) bool {
+	return s.cert.Leaf != nil && s.cert.Leaf.VerifyHostname(serverName) == nil
+}
+
+func buildACMEResolver(config ACMEResolverConfig) (*engine.ACMEResolver, error) {
+	var challenges []engine.ACMEChallenge
+	for _, challenge := range config.Challenges {
+		challenges = append(challenges, engine.ACMEChallenge(challenge))
+	}
+
+	var client *http.Client
+	if config.CA != "" {
+		pool, err := loadCertPool(config.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client = &http.Client{Transport: transport}
+	}
+
+	return engine.NewACMEResolver(engine.ACMEConfig{
+		DirectoryURL: config.Directory,
+		Email:        config.Email,
+		Domains:      config.Domains,
+		StorageDir:   config.Storage,
+		Challenges:   challenges,
+		HTTPClient:   client,
+	})
+}
+
+func buildClientAuth(config TLSConfig) (map[string]engine.ClientAuthPolicy, error) {
+	policies := make(map[string]engine.ClientAuthPolicy)
+
+	for name, policy := range config.ClientAuth {
+		mode := engine.ClientAuthMode(policy.Mode)
+		if (mode == engine.ClientAuthRequest || mode == engine.ClientAuthRequire) && policy.CA == "" {
+			return nil, fmt.Errorf("tls client-auth \"%s\": %s needs a ca", name, policy.Mode)
+		}
+
+		var pool *x509.CertPool
+		if policy.CA != "" {
+			var err error
+			pool, err = loadCertPool(policy.CA)
+			if err != nil {
+				return nil, fmt.Errorf("tls client-auth \"%s\": %w", name, err)
+			}
+		}
+
+		policies[strings.ToLower(name)] = engine.ClientAuthPolicy{
+			Mode: mode,
+			CAs:  pool,
+		}
+	}
+
+	return policies, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// sniTLSConfigHandler serves an entrypoint shared by routes with
+// different resolvers. The handlers come sorted by resolver name, the
+// first to hold a certificate for the SNI answers and otherwise the first
+// to answer with a default does, so overlapping resolvers always resolve
+// the same way.
+func sniTLSConfigHandler(handlers []engine.TLSConfigHandler) engine.TLSConfigHandler {
+	if len(handlers) == 1 {
+		return handlers[0]
+	}
+
+	return engine.TLSConfigHandlerFunc(func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, handler := range handlers {
+			if matcher, ok := handler.(engine.ServerNameMatcher); ok && matcher.MatchesServerName(info.ServerName) {
+				return handler.HandleTLSConfig(info)
+			}
+		}
+
+		var lastErr error
+		for _, handler := range handlers {
+			config, err := handler.HandleTLSConfig(info)
+			if err == nil {
+				return config, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	})
+}
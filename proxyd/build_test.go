@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aidanhopper/reverse-proxy/proxy-engine/engine"
+)
+
+func testCertificate(t *testing.T, names ...string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// TestSNITLSConfigHandler shares an entrypoint between resolvers that all
+// answer any server name, the one holding a certificate for the SNI must
+// win however often it is asked.
+func TestSNITLSConfigHandler(t *testing.T) {
+	other := testCertificate(t, "other.test")
+	wildcard := testCertificate(t, "*.example.com")
+	exact := testCertificate(t, "app.example.com")
+
+	// Sorted by resolver name as Reconsile passes them
+	handler := sniTLSConfigHandler([]engine.TLSConfigHandler{
+		staticCertificate{cert: other},
+		staticCertificate{cert: wildcard},
+		staticCertificate{cert: exact},
+	})
+
+	tests := []struct {
+		serverName string
+		want       tls.Certificate
+	}{
+		{"api.example.com", wildcard},
+		// Both later resolvers cover it, the first of them answers
+		{"app.example.com", wildcard},
+		{"other.test", other},
+		// Nothing covers it, the first resolver answers with its default
+		{"unknown.test", other},
+	}
+
+	for _, test := range tests {
+		for range 10 {
+			config, err := handler.HandleTLSConfig(&tls.ClientHelloInfo{ServerName: test.serverName})
+			if err != nil {
+				t.Fatalf("%s: %s", test.serverName, err)
+			}
+			if got := config.Certificates[0].Leaf; got != test.want.Leaf {
+				t.Fatalf("%s served %v, want %v", test.serverName, got.DNSNames, test.want.Leaf.DNSNames)
+			}
+		}
+	}
+}
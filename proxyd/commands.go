@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+func runValidate(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: proxyd validate <config>")
+		return 2
+	}
+
+	_, err := ReadServerConfig(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n%s\n", args[0], err)
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n", args[0])
+	return 0
+}
+
+func runDiff(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: proxyd diff <old config> <new config>")
+		return 2
+	}
+
+	oldConfig, err := ReadServerConfig(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n%s\n", args[0], err)
+		return 1
+	}
+
+	newConfig, err := ReadServerConfig(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n%s\n", args[1], err)
+		return 1
+	}
+
+	diff := DiffConfig(oldConfig, newConfig)
+	if diff.Empty() {
+		fmt.Println("No changes")
+		return 0
+	}
+
+	PrintConfigDiff(os.Stdout, diff)
+	return 0
+}
+
+func PrintConfigDiff(w io.Writer, diff ConfigDiff) {
+	sections := []struct {
+		name    string
+		changes ItemChanges
+	}{
+		{"entrypoints", diff.Entrypoints},
+		{"http middlewares", diff.HTTPMiddlewares},
+		{"http services", diff.HTTPServices},
+		{"http routers", diff.HTTPRouters},
+		{"http handlers", diff.HTTPHandlers},
+		{"tcp services", diff.TCPServices},
+		{"tcp routers", diff.TCPRouters},
+		{"tcp handlers", diff.TCPHandlers},
+		{"tls resolvers", diff.TLSResolvers},
+		{"tls handlers", diff.TLSHandlers},
+	}
+
+	for _, section := range sections {
+		if section.changes.Empty() {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s:\n", section.name)
+		for _, id := range section.changes.Added {
+			fmt.Fprintf(w, "  + %s\n", id)
+		}
+		for _, id := range section.changes.Changed {
+			fmt.Fprintf(w, "  ~ %s\n", id)
+		}
+		for _, id := range section.changes.Removed {
+			fmt.Fprintf(w, "  - %s\n", id)
+		}
+	}
+}
+
+func PrintReloadStatus(w io.Writer, status ReloadStatus) {
+	switch {
+	case status.Time.IsZero():
+		fmt.Fprintln(w, "Config not reloaded since startup")
+	case status.Err != nil:
+		fmt.Fprintf(w, "Config reload failed at %s: %s\n", status.Time.Format(time.RFC3339), status.Err)
+	default:
+		fmt.Fprintf(w, "Config reloaded at %s (%s)\n", status.Time.Format(time.RFC3339), status.Checksum[:12])
+	}
+}
+
+func PrintHealthStatus(w io.Writer, services []ServiceHealth) {
+	if len(services) == 0 {
+		fmt.Fprintln(w, "No health checked services")
+		return
+	}
+
+	for _, service := range services {
+		fmt.Fprintf(w, "%s service %s:\n", service.Protocol, service.Service)
+		for _, member := range service.Members {
+			health := "healthy"
+			if !member.Healthy {
+				health = "unhealthy"
+			}
+
+			fmt.Fprintf(w, "  %s %s", member.Name, health)
+			if member.Err != nil {
+				fmt.Fprintf(w, " (%s)", member.Err)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+type ServerConfig struct {
+	Entrypoints map[string]EntrypointConfig
+	HTTP        HTTPConfig
+	TCP         TCPConfig
+	TLS         TLSConfig
+
+	// Values interpolated from secrets, redacted when the config is logged
+	secrets []string
+	// Checksum of the files the config was read from
+	checksum string
+}
+
+// EntrypointConfig is written either as just the address to listen on or
+// as a mapping when it needs more than that.
+type EntrypointConfig struct {
+	Address       string
+	ProxyProtocol *ProxyProtocolConfig `yaml:"proxy-protocol"`
+	// How long a connection that sends nothing is given before it is
+	// labelled server-first, e.g. "250ms". Off unless set, as it delays
+	// every connection to a server first protocol by that long.
+	ServerFirstTimeout string `yaml:"server-first-timeout"`
+}
+
+type ProxyProtocolConfig struct {
+	// CIDRs of the load balancers allowed to send PROXY protocol headers
+	Trusted []string
+	// How long a trusted load balancer has to send the header, e.g. "5s"
+	Timeout string
+}
+
+type entrypointConfig EntrypointConfig
+
+func (c *EntrypointConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*c = EntrypointConfig{}
+		return value.Decode(&c.Address)
+	}
+	return value.Decode((*entrypointConfig)(c))
+}
+
+func (c EntrypointConfig) MarshalYAML() (any, error) {
+	if c.ProxyProtocol == nil && c.ServerFirstTimeout == "" {
+		return c.Address, nil
+	}
+	return entrypointConfig(c), nil
+}
+
+type HTTPConfig struct {
+	// Applied to every HTTP route
+	Middlewares           []string
+	MiddlewareDefinitions map[string]MiddlewareConfig `yaml:"middleware-definitions"`
+	Routes                map[string]HTTPRouteConfig
+	Services              map[string]HTTPServiceConfig
+}
+
+type MiddlewareConfig struct {
+	StripPrefix string `yaml:"strip-prefix"`
+	Logging     string
+	Chain       []string
+}
+
+type HTTPRouteConfig struct {
+	Rule        string
+	Service     string
+	Middlewares []string
+	Entrypoints []string
+	TLS         string
+	Priority    int
+}
+
+type HTTPServiceConfig struct {
+	ReverseProxy string                  `yaml:"reverse-proxy"`
+	LoadBalancer *HTTPLoadBalancerConfig `yaml:"load-balancer"`
+	FileServer   string                  `yaml:"file-server"`
+	Redirect     string
+	// Sends a PROXY protocol header to the reverse-proxy backend
+	ProxyProtocol *UpstreamProxyProtocolConfig `yaml:"proxy-protocol"`
+	// Tunes the connections kept to the reverse-proxy backend
+	Transport *HTTPTransportConfig
+	// Verifies and authenticates to the reverse-proxy backend, which is
+	// https unless its address says otherwise
+	TLS *UpstreamTLSConfig
+	// Share of requests relative to the other services of a load-balancer,
+	// defaults to 1
+	Weight int
+}
+
+// HTTPTransportConfig durations are written like "90s", unset fields
+// take the engine's defaults.
+type HTTPTransportConfig struct {
+	MaxIdleConns          int    `yaml:"max-idle-conns"`
+	MaxIdleConnsPerHost   int    `yaml:"max-idle-conns-per-host"`
+	IdleConnTimeout       string `yaml:"idle-conn-timeout"`
+	DialTimeout           string `yaml:"dial-timeout"`
+	ResponseHeaderTimeout string `yaml:"response-header-timeout"`
+	// Interval of TCP keep-alive probes, or "off"
+	KeepAlive string `yaml:"keep-alive"`
+	// Speaks HTTP/2 with prior knowledge to http:// backends
+	HTTP2 bool `yaml:"http2"`
+}
+
+type HTTPLoadBalancerConfig struct {
+	// random, round-robin, weighted-round-robin, least-connections or
+	// p2c-ewma, defaults to random
+	Method string
+	// Checks every reverse-proxy service, others are always healthy
+	HealthCheck *HealthCheckConfig `yaml:"health-check"`
+	// Ejects services that fail requests, any 5xx response counts
+	OutlierDetection *OutlierDetectionConfig `yaml:"outlier-detection"`
+	Services         []HTTPServiceConfig
+	// Only used while every service is unhealthy
+	Backup []HTTPServiceConfig
+}
+
+type HealthCheckConfig struct {
+	// http, tcp or minecraft, defaults to http for http services and tcp
+	// for tcp services
+	Type string
+	// Path http checks request, defaults to /
+	Path string
+	// Status http checks expect, defaults to any 2xx or 3xx
+	Status int
+	// Regular expression http check bodies must match
+	Body string
+	// e.g. "10s"
+	Interval string
+	Timeout  string
+	// Passing checks in a row for a backend to become healthy
+	Rise int
+	// Failing checks in a row for a backend to become unhealthy
+	Fall int
+}
+
+type TCPConfig struct {
+	Routes   map[string]TCPRouteConfig
+	Services map[string]TCPServiceConfig
+}
+
+type TCPRouteConfig struct {
+	Rule        string
+	Service     string
+	Entrypoints []string
+	Priority    int
+	// Terminates TLS with this resolver and forwards plaintext
+	TLS string
+}
+
+type TCPServiceConfig struct {
+	ReverseProxy string                 `yaml:"reverse-proxy"`
+	LoadBalancer *TCPLoadBalancerConfig `yaml:"load-balancer"`
+	// Originates TLS to the reverse-proxy backend
+	TLS *UpstreamTLSConfig
+	// Sends a PROXY protocol header to the reverse-proxy backend
+	ProxyProtocol *UpstreamProxyProtocolConfig `yaml:"proxy-protocol"`
+	// Share of connections relative to the other services of a
+	// load-balancer, defaults to 1
+	Weight int
+}
+
+type UpstreamProxyProtocolConfig struct {
+	// 1 or 2
+	Version int
+	// TLVs added to v2 headers, sni and alpn
+	TLVs []string
+}
+
+type UpstreamTLSConfig struct {
+	// Defaults to the host of the backend address
+	ServerName string `yaml:"server-name"`
+	// CA bundle the backend's certificate is verified against, defaults
+	// to the system roots
+	CA string
+	// Client certificate and key presented to backends that ask for one
+	Certificate string
+	Key         string
+	// Accepts any certificate, for lab use only
+	InsecureSkipVerify bool `yaml:"insecure-skip-verify"`
+	// 1.0, 1.1, 1.2 or 1.3, defaults to 1.2
+	MinVersion string `yaml:"min-version"`
+}
+
+type TCPLoadBalancerConfig struct {
+	// Same methods as HTTP load balancers
+	Method      string
+	HealthCheck *HealthCheckConfig `yaml:"health-check"`
+	// Connections to services that cannot be dialed count as failures
+	OutlierDetection *OutlierDetectionConfig `yaml:"outlier-detection"`
+	Services         []TCPServiceConfig
+	Backup           []TCPServiceConfig
+}
+
+type OutlierDetectionConfig struct {
+	// Failures in a row that eject a service, defaults to 5
+	ConsecutiveFailures int `yaml:"consecutive-failures"`
+	// Percentage of requests within interval that have to fail to eject a
+	// service, off by default
+	FailurePercent int `yaml:"failure-percent"`
+	// Requests needed within interval before failure-percent applies,
+	// defaults to 10
+	MinimumRequests int `yaml:"minimum-requests"`
+	// e.g. "10s"
+	Interval string
+	// How long the first ejection lasts, doubling with every ejection after
+	// it, defaults to 30s
+	BaseEjectionTime string `yaml:"base-ejection-time"`
+	// Defaults to 5m
+	MaxEjectionTime string `yaml:"max-ejection-time"`
+	// Most services ejected at once, defaults to 50
+	MaxEjectionPercent int `yaml:"max-ejection-percent"`
+}
+
+type TLSConfig struct {
+	Resolvers map[string]TLSResolverConfig
+	// Client certificate policies keyed by server name, "*.example.com"
+	// covers one level of subdomains and "" every other name
+	ClientAuth map[string]ClientAuthConfig `yaml:"client-auth"`
+}
+
+type ClientAuthConfig struct {
+	// none, request or require
+	Mode string
+	// CA bundle client certificates are verified against
+	CA string
+}
+
+type TLSResolverConfig struct {
+	Certificate string
+	Key         string
+	// Every certificate in the directory, picked by SNI
+	Directory string
+	// Base name of the directory's certificate served for unknown SNI
+	Default string
+	ACME    *ACMEResolverConfig
+}
+
+type ACMEResolverConfig struct {
+	Email     string
+	Domains   []string
+	Storage   string
+	Directory string
+	// CA bundle trusted when talking to the ACME server, e.g. Pebble's
+	CA         string
+	Challenges []string
+}
+
+// ReadServerConfig loads a config file, or every config file in a
+// directory merged into one config. Environment variables and secret files
+// are interpolated into the string values of the parsed files.
+func ReadServerConfig(path string) (ServerConfig, error) {
+	interpolator := newInterpolator()
+
+	tree, checksum, err := readConfigTree(path, interpolator.interpolate)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+
+	data, err := yaml.Marshal(tree)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+
+	newConfig := ServerConfig{}
+	err = yaml.Unmarshal(data, &newConfig)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+
+	newConfig.secrets = interpolator.secrets
+	newConfig.checksum = checksum
+
+	err = ValidateConfig(newConfig)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+
+	return newConfig, nil
+}
+
+// routeEntrypoints returns the entrypoints a route is attached to. Routes
+// that do not list any are attached to every entrypoint.
+func routeEntrypoints(config ServerConfig, listed []string) []string {
+	if len(listed) > 0 {
+		return listed
+	}
+
+	var all []string
+	for id := range config.Entrypoints {
+		all = append(all, id)
+	}
+	return all
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var configExtensions = []string{".yml", ".yaml", ".json", ".toml"}
+
+func isConfigFile(path string) bool {
+	base := filepath.Base(path)
+	if strings.HasPrefix(base, ".") {
+		return false
+	}
+	return slices.Contains(configExtensions, strings.ToLower(filepath.Ext(base)))
+}
+
+// configFiles lists the files a config path is made of. A directory
+// contributes every config file directly inside it, in name order.
+func configFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		file := filepath.Join(path, entry.Name())
+		if !isConfigFile(file) {
+			continue
+		}
+		// Entries may be symlinks, only keep the ones pointing at files
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			continue
+		}
+		files = append(files, file)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config files found in %s", path)
+	}
+
+	return files, nil
+}
+
+func decodeConfigFile(path string, data []byte) (map[string]any, error) {
+	tree := make(map[string]any)
+
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		err = yaml.Unmarshal(data, &tree)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return tree, nil
+}
+
+// mergeConfigTree merges src into dst. Maps are merged key by key, any
+// other value defined by two files is a conflict reported against both.
+func mergeConfigTree(dst map[string]any, src map[string]any, file string, origins map[string]string, prefix string) []error {
+	var errs []error
+
+	for _, key := range slices.Sorted(maps.Keys(src)) {
+		value := src[key]
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		existing, present := dst[key]
+		if !present {
+			dst[key] = value
+			markOrigins(value, file, origins, path)
+			continue
+		}
+
+		existingMap, existingIsMap := existing.(map[string]any)
+		valueMap, valueIsMap := value.(map[string]any)
+		if existingIsMap && valueIsMap {
+			errs = append(errs, mergeConfigTree(existingMap, valueMap, file, origins, path)...)
+			continue
+		}
+
+		errs = append(errs, fmt.Errorf(
+			"%s is defined in both %s and %s",
+			path,
+			origins[path],
+			file,
+		))
+	}
+
+	return errs
+}
+
+func markOrigins(value any, file string, origins map[string]string, path string) {
+	origins[path] = file
+	if m, ok := value.(map[string]any); ok {
+		for key, child := range m {
+			markOrigins(child, file, origins, path+"."+key)
+		}
+	}
+}
+
+// readConfigTree reads every file making up path and merges them into a
+// single tree. Each file's parsed tree goes through transform first. The
+// checksum covers the bytes that were parsed.
+func readConfigTree(path string, transform func(file string, tree map[string]any) error) (map[string]any, string, error) {
+	files, err := configFiles(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	merged := make(map[string]any)
+	origins := make(map[string]string)
+	hash := sha256.New()
+
+	var errs []error
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		hashConfigFile(hash, file, data)
+
+		tree, err := decodeConfigFile(file, data)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tree = normalizeConfigTree(tree).(map[string]any)
+
+		if transform != nil {
+			if err := transform(file, tree); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+
+		errs = append(errs, mergeConfigTree(merged, tree, file, origins, "")...)
+	}
+
+	if len(errs) > 0 {
+		return nil, "", errors.Join(errs...)
+	}
+
+	return merged, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// normalizeConfigTree converts the map types produced by the different
+// decoders into map[string]any so that trees can be merged.
+func normalizeConfigTree(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			v[key] = normalizeConfigTree(child)
+		}
+		return v
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, child := range v {
+			m[fmt.Sprint(key)] = normalizeConfigTree(child)
+		}
+		return m
+	case []map[string]any:
+		s := make([]any, len(v))
+		for i, child := range v {
+			s[i] = normalizeConfigTree(child)
+		}
+		return s
+	case []any:
+		for i, child := range v {
+			v[i] = normalizeConfigTree(child)
+		}
+		return v
+	}
+	return value
+}
@@ -3,11 +3,17 @@ module github.com/aidanhopper/reverse-proxy/proxyd
 go 1.25.1
 
 require (
-	github.com/fsnotify/fsnotify v1.9.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/crypto v0.55.0 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
 )
 
-require github.com/aidanhopper/reverse-proxy/proxy-engine v0.0.0
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/aidanhopper/reverse-proxy/proxy-engine v0.0.0
+	github.com/fsnotify/fsnotify v1.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 replace github.com/aidanhopper/reverse-proxy/proxy-engine => ../proxy-engine
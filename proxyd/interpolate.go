@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// Variables with names like these are treated as secrets
+	sensitiveName = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|HASH|CREDENTIAL|PRIVATE|_KEY$|^KEY$)`)
+)
+
+// interpolator expands ${VAR}, ${VAR:-default} and ${file:/path} in the
+// string values of parsed config files. $$ escapes a literal dollar sign.
+// Values read from files and from variables that look sensitive are
+// remembered so they can be redacted whenever the config is logged.
+type interpolator struct {
+	lookupEnv func(string) (string, bool)
+	readFile  func(string) ([]byte, error)
+	secrets   []string
+}
+
+func newInterpolator() *interpolator {
+	return &interpolator{
+		lookupEnv: os.LookupEnv,
+		readFile:  os.ReadFile,
+	}
+}
+
+// interpolatedValue is a string value a variable was expanded into. It is
+// written back as a plain scalar, so a value such as ${PORT} still decodes
+// into a number while whatever the variable holds stays a single value.
+type interpolatedValue string
+
+func (v interpolatedValue) MarshalYAML() (any, error) {
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: string(v)}, nil
+}
+
+// interpolate expands every string value in a file's parsed tree. Keys
+// and comments are left alone.
+func (in *interpolator) interpolate(file string, tree map[string]any) error {
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(tree)) {
+		tree[key] = in.interpolateValue(tree[key], key, func(path string, err error) {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", file, path, err))
+		})
+	}
+	return errors.Join(errs...)
+}
+
+func (in *interpolator) interpolateValue(value any, path string, report func(path string, err error)) any {
+	switch v := value.(type) {
+	case string:
+		expanded, changed, err := in.interpolateString(v)
+		if err != nil {
+			report(path, err)
+			return v
+		}
+		if changed {
+			return interpolatedValue(expanded)
+		}
+		return expanded
+	case map[string]any:
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			v[key] = in.interpolateValue(v[key], path+"."+key, report)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = in.interpolateValue(child, fmt.Sprintf("%s[%d]", path, i), report)
+		}
+	}
+	return value
+}
+
+// interpolateString expands the placeholders in one value and reports
+// whether any variable was expanded.
+func (in *interpolator) interpolateString(src string) (string, bool, error) {
+	if !strings.Contains(src, "$") {
+		return src, false, nil
+	}
+
+	var out strings.Builder
+	var errs []error
+	expanded := false
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		if c == '$' && i+1 < len(src) && src[i+1] == '$' {
+			out.WriteByte('$')
+			i += 2
+			continue
+		}
+
+		if c == '$' && i+1 < len(src) && src[i+1] == '{' {
+			end := strings.IndexByte(src[i+2:], '}')
+			if end == -1 {
+				errs = append(errs, fmt.Errorf("unterminated ${"))
+				break
+			}
+
+			value, err := in.expand(src[i+2 : i+2+end])
+			if err != nil {
+				errs = append(errs, err)
+			}
+			out.WriteString(value)
+			expanded = true
+
+			i += end + 3
+			continue
+		}
+
+		out.WriteByte(c)
+		i++
+	}
+
+	if len(errs) > 0 {
+		return "", false, errors.Join(errs...)
+	}
+
+	return out.String(), expanded, nil
+}
+
+func (in *interpolator) expand(expr string) (string, error) {
+	if path, ok := strings.CutPrefix(expr, "file:"); ok {
+		data, err := in.readFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading secret file: %w", err)
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		in.addSecret(value)
+		return value, nil
+	}
+
+	name, fallback, hasDefault := strings.Cut(expr, ":-")
+	if !variableName.MatchString(name) {
+		return "", fmt.Errorf("invalid variable name \"%s\"", name)
+	}
+
+	value, ok := in.lookupEnv(name)
+	if !ok || value == "" {
+		if !hasDefault {
+			return "", fmt.Errorf("required variable %s is not set", name)
+		}
+		value = fallback
+	}
+
+	if sensitiveName.MatchString(name) {
+		in.addSecret(value)
+	}
+
+	return value, nil
+}
+
+func (in *interpolator) addSecret(value string) {
+	if value != "" && !slices.Contains(in.secrets, value) {
+		in.secrets = append(in.secrets, value)
+	}
+}
+
+func redactSecrets(value any, secrets []string) any {
+	switch v := value.(type) {
+	case string:
+		for _, secret := range secrets {
+			v = strings.ReplaceAll(v, secret, redacted)
+		}
+		return v
+	case map[string]any:
+		for key, child := range v {
+			v[key] = redactSecrets(child, secrets)
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = redactSecrets(child, secrets)
+		}
+		return v
+	}
+	return value
+}
+
+// String renders the config as YAML with every secret value redacted, so
+// it is safe to log.
+func (c ServerConfig) String() string {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("<unprintable config: %s>", err)
+	}
+
+	var tree any
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return fmt.Sprintf("<unprintable config: %s>", err)
+	}
+
+	// Longest first so a secret containing another is fully replaced
+	secrets := slices.Clone(c.secrets)
+	slices.SortFunc(secrets, func(a, b string) int {
+		return len(b) - len(a)
+	})
+
+	data, err = yaml.Marshal(redactSecrets(tree, secrets))
+	if err != nil {
+		return fmt.Sprintf("<unprintable config: %s>", err)
+	}
+
+	return string(data)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestInterpolateSpecialCharacters expands values that would change the
+// structure of the file if they were pasted into its text.
+func TestInterpolateSpecialCharacters(t *testing.T) {
+	values := []string{
+		"a: b",
+		"value # not a comment",
+		"first line\nsecond: line",
+		`"double" and 'single' quotes`,
+		"- looks like a list",
+		"{flow: map}",
+		"${NOT_EXPANDED_AGAIN}",
+		"8080",
+	}
+
+	files := map[string]string{
+		"config.yml": `
+entrypoints:
+  web: ":80"
+http:
+  services:
+    files:
+      file-server: ${SERVED_DIR}
+`,
+		"config.toml": `
+[entrypoints]
+web = ":80"
+
+[http.services.files]
+file-server = "${SERVED_DIR}"
+`,
+		"config.json": `{
+  "entrypoints": {"web": ":80"},
+  "http": {"services": {"files": {"file-server": "${SERVED_DIR}"}}}
+}`,
+	}
+
+	for name, content := range files {
+		for _, value := range values {
+			t.Run(name+" "+value, func(t *testing.T) {
+				t.Setenv("SERVED_DIR", value)
+
+				config, err := ReadServerConfig(writeConfig(t, name, content))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got := config.HTTP.Services["files"].FileServer; got != value {
+					t.Errorf("file-server %q, want %q", got, value)
+				}
+				if len(config.HTTP.Services) != 1 || len(config.Entrypoints) != 1 {
+					t.Errorf("value changed the structure of the config: %+v", config)
+				}
+			})
+		}
+	}
+}
+
+func TestInterpolateTypedValues(t *testing.T) {
+	t.Setenv("WEIGHT", "3")
+
+	config, err := ReadServerConfig(writeConfig(t, "config.yml", `
+entrypoints:
+  web: ":80"
+http:
+  services:
+    balanced:
+      load-balancer:
+        services:
+          - reverse-proxy: http://127.0.0.1:8080
+            weight: ${WEIGHT}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := config.HTTP.Services["balanced"].LoadBalancer.Services[0].Weight; got != 3 {
+		t.Errorf("weight %d, want 3", got)
+	}
+}
+
+func TestInterpolateIgnoresComments(t *testing.T) {
+	path := writeConfig(t, "config.yml", `
+# Set ${UNSET_IN_COMMENT} before starting
+entrypoints:
+  web: ":80" # or ${ALSO_UNSET}
+http:
+  services:
+    files:
+      file-server: /srv # ${UNSET_AFTER_VALUE}
+`)
+
+	config, err := ReadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := config.HTTP.Services["files"].FileServer; got != "/srv" {
+		t.Errorf("file-server %q, want /srv", got)
+	}
+}
+
+func TestInterpolateErrors(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"${UNSET_VARIABLE}", "http.services.files.file-server: required variable UNSET_VARIABLE is not set"},
+		{"${UNTERMINATED", "unterminated ${"},
+		{"${not a name}", "invalid variable name"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			_, err := ReadServerConfig(writeConfig(t, "config.yml", `
+entrypoints:
+  web: ":80"
+http:
+  services:
+    files:
+      file-server: "`+test.value+`"
+`))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error %v, want it to mention %q", err, test.want)
+			}
+		})
+	}
+}
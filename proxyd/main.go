@@ -3,171 +3,94 @@ package main
 import (
 	"context"
 	"log"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"os"
 
 	"github.com/aidanhopper/reverse-proxy/proxy-engine/engine"
-	"github.com/fsnotify/fsnotify"
-	"gopkg.in/yaml.v3"
-	// "gopkg.in/yaml.v3"
 )
 
-type ServerConfig struct {
-	Entrypoints map[string]string
-	HTTP        struct {
-		Middlewares []string
-		Routes      map[string]struct {
-			Rule        string
-			Service     string
-			Middlewares []string
-			Entrypoints []string
-			TLS         string
-		}
-		Services map[string]struct {
-			ReverseProxy string `yaml:"reverse-proxy"`
-			LoadBalancer struct {
-				Method   string
-				Services []struct {
-					ReverseProxy string `yaml:"reverse-proxy"`
-				}
-			} `yaml:"load-balancer"`
-		}
-	}
-}
-
-type State struct {
-	Config ServerConfig
-	Server *engine.Server
-}
-
-type MapItem[T any] struct {
-	key  string
-	item T
-}
-
-func UpdatedMapItems[T comparable](old map[string]T, updated map[string]T) []MapItem[T] {
-	var ret []MapItem[T]
-	for key, updatedValue := range updated {
-		oldValue, present := old[key]
-		if !present || oldValue != updatedValue {
-			ret = append(ret, MapItem[T]{
-				key,
-				updatedValue,
-			})
-			continue
-		}
-	}
-	return ret
-}
+const shutdownTimeout = 30 * time.Second
 
-func DeletedMapItems[T comparable](old map[string]T, updated map[string]T) []MapItem[T] {
-	var ret []MapItem[T]
-	for key, oldValue := range old {
-		_, present := updated[key]
-		if !present {
-			ret = append(ret, MapItem[T]{
-				key,
-				oldValue,
-			})
-			continue
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "validate":
+			os.Exit(runValidate(args[1:]))
+		case "diff":
+			os.Exit(runDiff(args[1:]))
 		}
 	}
-	return ret
-}
-
-func ChangedMapItems[T comparable](old map[string]T, updated map[string]T) ([]MapItem[T], []MapItem[T]) {
-	return UpdatedMapItems(old, updated), DeletedMapItems(old, updated)
-}
-
-func (state *State) Reconsile(newConfig ServerConfig) {
-	log.Println(newConfig)
-
-	// Update entrypoints
-	updated, deleted := ChangedMapItems(state.Config.Entrypoints, newConfig.Entrypoints)
-	for _, value := range deleted {
-		state.Server.DeregisterEntryPoint(value.key)
-	}
 
-	for _, value := range updated {
-		// Will need to change this to look if its a http/tcp, udp, or unix entrypoint
-		state.Server.RegisterEntryPoint(engine.TCPEntryPoint{
-			Identifier: value.key,
-			Address:    value.item,
-		})
+	if len(args) != 1 {
+		log.Fatal("Please specify path to config file or directory")
 	}
+	configPath := args[0]
 
-	state.Config = newConfig
-}
-
-func ReadServerConfig(path string) (ServerConfig, error) {
-	data, err := os.ReadFile(path)
+	config, err := ReadServerConfig(configPath)
 	if err != nil {
-		return ServerConfig{}, err
+		log.Fatal(err)
 	}
 
-	newConfig := ServerConfig{}
-	err = yaml.Unmarshal(data, &newConfig)
-	if err != nil {
-		return ServerConfig{}, err
-	}
+	state := NewState(engine.NewServer())
 
-	return newConfig, nil
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-func main() {
-	args := os.Args
-	if len(args) != 2 {
-		log.Fatal("Please specify path to config file")
-	}
-	configPath := args[1]
+	go state.Server.Serve(ctx)
 
-	config, err := ReadServerConfig(configPath)
+	err = state.Reconsile(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	watcher, err := fsnotify.NewWatcher()
+	watcher, err := NewConfigWatcher(configPath, config.checksum, func() (string, error) {
+		newConfig, err := ReadServerConfig(configPath)
+		if err != nil {
+			return "", err
+		}
+		return newConfig.checksum, state.Reconsile(newConfig)
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer watcher.Close()
 
-	state := &State{
-		Server: engine.NewServer(),
-	}
-
-	go state.Server.Serve(context.Background())
+	go watcher.Run(ctx)
 
-	state.Reconsile(config)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			watcher.Reload()
+		}
+	}()
 
+	// SIGUSR1 logs the last config reload and the health of every checked
+	// load balancer member
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
 	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if event.Name == configPath && event.Has(fsnotify.Create) {
-					newConfig, err := ReadServerConfig(configPath)
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-					state.Reconsile(newConfig)
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Println("error:", err)
-			}
+		for range usr1 {
+			var status strings.Builder
+			PrintReloadStatus(&status, watcher.Status())
+			PrintHealthStatus(&status, state.HealthStatus())
+			log.Printf("Status:\n%s", status.String())
 		}
 	}()
 
-	err = watcher.Add(".")
+	<-ctx.Done()
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = state.Server.Shutdown(shutdownCtx)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Shutdown did not complete cleanly: %s\n", err)
 	}
-
-	select {}
 }
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aidanhopper/reverse-proxy/proxy-engine/engine"
+)
+
+type State struct {
+	Config ServerConfig
+	Server *engine.Server
+
+	httpCompiler *engine.HTTPHandlerCompiler
+	tcpCompiler  *engine.TCPHandlerCompiler
+	tlsResolvers map[string]engine.TLSConfigHandler
+	// Handlers published to the server, a reload publishes a complete
+	// copy of them in one step
+	handlers engine.Handlers
+
+	// Health checkers run by each service's load balancers, healthMu lets
+	// HealthStatus read them while a reload replaces them
+	healthMu           sync.Mutex
+	httpHealthCheckers map[string][]*engine.HealthChecker
+	tcpHealthCheckers  map[string][]*engine.HealthChecker
+}
+
+func NewState(server *engine.Server) *State {
+	return &State{
+		Server:       server,
+		httpCompiler: engine.NewHTTPHandlerCompiler(),
+		tcpCompiler:  engine.NewTCPHandlerCompiler(),
+		tlsResolvers: make(map[string]engine.TLSConfigHandler),
+		handlers: engine.Handlers{
+			HTTP:      make(map[string]http.Handler),
+			TCP:       make(map[string]engine.TCPHandler),
+			TLSConfig: make(map[string]engine.TLSConfigHandler),
+		},
+
+		httpHealthCheckers: make(map[string][]*engine.HealthChecker),
+		tcpHealthCheckers:  make(map[string][]*engine.HealthChecker),
+	}
+}
+
+type MapItem[T any] struct {
+	key  string
+	item T
+}
+
+func UpdatedMapItemsFunc[T any](old map[string]T, updated map[string]T, equal func(a, b T) bool) []MapItem[T] {
+	var ret []MapItem[T]
+	for key, updatedValue := range updated {
+		oldValue, present := old[key]
+		if !present || !equal(oldValue, updatedValue) {
+			ret = append(ret, MapItem[T]{
+				key,
+				updatedValue,
+			})
+			continue
+		}
+	}
+	return ret
+}
+
+func DeletedMapItems[T any](old map[string]T, updated map[string]T) []MapItem[T] {
+	var ret []MapItem[T]
+	for key, oldValue := range old {
+		_, present := updated[key]
+		if !present {
+			ret = append(ret, MapItem[T]{
+				key,
+				oldValue,
+			})
+			continue
+		}
+	}
+	return ret
+}
+
+func UpdatedMapItems[T comparable](old map[string]T, updated map[string]T) []MapItem[T] {
+	return UpdatedMapItemsFunc(old, updated, func(a, b T) bool {
+		return a == b
+	})
+}
+
+func ChangedMapItems[T comparable](old map[string]T, updated map[string]T) ([]MapItem[T], []MapItem[T]) {
+	return UpdatedMapItems(old, updated), DeletedMapItems(old, updated)
+}
+
+func ChangedMapItemsFunc[T any](old map[string]T, updated map[string]T, equal func(a, b T) bool) ([]MapItem[T], []MapItem[T]) {
+	return UpdatedMapItemsFunc(old, updated, equal), DeletedMapItems(old, updated)
+}
+
+type ItemChanges struct {
+	Added   []string
+	Changed []string
+	Removed []string
+}
+
+func (c ItemChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Changed) == 0 && len(c.Removed) == 0
+}
+
+// Updated returns the added and changed items.
+func (c ItemChanges) Updated() []string {
+	return slices.Concat(c.Added, c.Changed)
+}
+
+func (c ItemChanges) Affects(key string) bool {
+	return slices.Contains(c.Added, key) ||
+		slices.Contains(c.Changed, key) ||
+		slices.Contains(c.Removed, key)
+}
+
+func itemChanges[T any](old map[string]T, updated map[string]T, equal func(a, b T) bool) ItemChanges {
+	var changes ItemChanges
+
+	updatedItems, deletedItems := ChangedMapItemsFunc(old, updated, equal)
+	for _, item := range updatedItems {
+		if _, present := old[item.key]; present {
+			changes.Changed = append(changes.Changed, item.key)
+		} else {
+			changes.Added = append(changes.Added, item.key)
+		}
+	}
+	for _, item := range deletedItems {
+		changes.Removed = append(changes.Removed, item.key)
+	}
+
+	slices.Sort(changes.Added)
+	slices.Sort(changes.Changed)
+	slices.Sort(changes.Removed)
+
+	return changes
+}
+
+func deepEqual[T any](a, b T) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// ConfigDiff is the set of engine objects a reload adds, changes or
+// removes. Handlers are keyed by entrypoint and are recompiled whenever a
+// router or service they are built from changes.
+type ConfigDiff struct {
+	Entrypoints     ItemChanges
+	HTTPMiddlewares ItemChanges
+	HTTPServices    ItemChanges
+	HTTPRouters     ItemChanges
+	HTTPHandlers    ItemChanges
+	TCPServices     ItemChanges
+	TCPRouters      ItemChanges
+	TCPHandlers     ItemChanges
+	TLSResolvers    ItemChanges
+	TLSHandlers     ItemChanges
+}
+
+func (d ConfigDiff) Empty() bool {
+	return d.Entrypoints.Empty() &&
+		d.HTTPMiddlewares.Empty() &&
+		d.HTTPServices.Empty() &&
+		d.HTTPRouters.Empty() &&
+		d.HTTPHandlers.Empty() &&
+		d.TCPServices.Empty() &&
+		d.TCPRouters.Empty() &&
+		d.TCPHandlers.Empty() &&
+		d.TLSResolvers.Empty() &&
+		d.TLSHandlers.Empty()
+}
+
+func httpEntrypointRoutes(config ServerConfig) map[string][]string {
+	ret := make(map[string][]string)
+	for routeId, route := range config.HTTP.Routes {
+		for _, e := range routeEntrypoints(config, route.Entrypoints) {
+			if _, ok := config.Entrypoints[e]; ok {
+				ret[e] = append(ret[e], routeId)
+			}
+		}
+	}
+	for e := range ret {
+		slices.Sort(ret[e])
+	}
+	return ret
+}
+
+func tcpEntrypointRoutes(config ServerConfig) map[string][]string {
+	ret := make(map[string][]string)
+	for routeId, route := range config.TCP.Routes {
+		for _, e := range routeEntrypoints(config, route.Entrypoints) {
+			if _, ok := config.Entrypoints[e]; ok {
+				ret[e] = append(ret[e], routeId)
+			}
+		}
+	}
+	for e := range ret {
+		slices.Sort(ret[e])
+	}
+	return ret
+}
+
+func entrypointResolvers(config ServerConfig) map[string][]string {
+	ret := make(map[string][]string)
+	add := func(resolver string, entrypoints []string) {
+		if resolver == "" {
+			return
+		}
+		for _, e := range routeEntrypoints(config, entrypoints) {
+			if _, ok := config.Entrypoints[e]; ok && !slices.Contains(ret[e], resolver) {
+				ret[e] = append(ret[e], resolver)
+			}
+		}
+	}
+	for _, route := range config.HTTP.Routes {
+		add(route.TLS, route.Entrypoints)
+	}
+	for _, route := range config.TCP.Routes {
+		add(route.TLS, route.Entrypoints)
+	}
+	for e := range ret {
+		slices.Sort(ret[e])
+	}
+	return ret
+}
+
+// acmeResolvers lists the resolvers whose HTTP-01 challenges are answered
+// on every entrypoint with HTTP routes.
+func acmeResolvers(config ServerConfig) []string {
+	var ret []string
+	for id, resolver := range config.TLS.Resolvers {
+		if resolver.ACME != nil {
+			ret = append(ret, id)
+		}
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+// dependentChanges diffs entrypoint memberships and also marks an
+// entrypoint as changed when any member it still has was updated.
+func dependentChanges(old, updated map[string][]string, members ItemChanges, extra func(member string) bool) ItemChanges {
+	changes := itemChanges(old, updated, slices.Equal)
+
+	for e, ids := range updated {
+		if _, present := old[e]; !present || slices.Contains(changes.Changed, e) {
+			continue
+		}
+		for _, id := range ids {
+			if members.Affects(id) || (extra != nil && extra(id)) {
+				changes.Changed = append(changes.Changed, e)
+				break
+			}
+		}
+	}
+
+	slices.Sort(changes.Changed)
+	return changes
+}
+
+// changeAll marks every entrypoint that is kept as changed.
+func changeAll(changes ItemChanges, old, updated map[string][]string) ItemChanges {
+	for e := range updated {
+		if _, present := old[e]; present && !slices.Contains(changes.Changed, e) {
+			changes.Changed = append(changes.Changed, e)
+		}
+	}
+	slices.Sort(changes.Changed)
+	return changes
+}
+
+func DiffConfig(old, updated ServerConfig) ConfigDiff {
+	var diff ConfigDiff
+
+	diff.Entrypoints = itemChanges(old.Entrypoints, updated.Entrypoints, deepEqual)
+
+	diff.HTTPMiddlewares = itemChanges(
+		old.HTTP.MiddlewareDefinitions,
+		updated.HTTP.MiddlewareDefinitions,
+		deepEqual,
+	)
+
+	globalChanged := !slices.Equal(old.HTTP.Middlewares, updated.HTTP.Middlewares) ||
+		!reflect.DeepEqual(
+			referencedMiddlewares(old.HTTP, old.HTTP.Middlewares),
+			referencedMiddlewares(updated.HTTP, updated.HTTP.Middlewares),
+		)
+
+	diff.HTTPRouters = itemChanges(old.HTTP.Routes, updated.HTTP.Routes, func(a, b HTTPRouteConfig) bool {
+		return !globalChanged &&
+			reflect.DeepEqual(a, b) &&
+			reflect.DeepEqual(
+				referencedMiddlewares(old.HTTP, a.Middlewares),
+				referencedMiddlewares(updated.HTTP, b.Middlewares),
+			)
+	})
+
+	diff.HTTPServices = itemChanges(old.HTTP.Services, updated.HTTP.Services, deepEqual)
+
+	diff.HTTPHandlers = dependentChanges(
+		httpEntrypointRoutes(old),
+		httpEntrypointRoutes(updated),
+		diff.HTTPRouters,
+		func(routeId string) bool {
+			return diff.HTTPServices.Affects(updated.HTTP.Routes[routeId].Service)
+		},
+	)
+
+	diff.TCPRouters = itemChanges(old.TCP.Routes, updated.TCP.Routes, deepEqual)
+	diff.TCPServices = itemChanges(old.TCP.Services, updated.TCP.Services, deepEqual)
+
+	diff.TCPHandlers = dependentChanges(
+		tcpEntrypointRoutes(old),
+		tcpEntrypointRoutes(updated),
+		diff.TCPRouters,
+		func(routeId string) bool {
+			return diff.TCPServices.Affects(updated.TCP.Routes[routeId].Service)
+		},
+	)
+
+	diff.TLSResolvers = itemChanges(old.TLS.Resolvers, updated.TLS.Resolvers, deepEqual)
+
+	diff.TLSHandlers = dependentChanges(
+		entrypointResolvers(old),
+		entrypointResolvers(updated),
+		diff.TLSResolvers,
+		nil,
+	)
+
+	// HTTP handlers embed the challenge middleware of every ACME resolver,
+	// so they are rebuilt whenever one of those resolvers is replaced
+	acme := acmeResolvers(updated)
+	if !slices.Equal(acmeResolvers(old), acme) || slices.ContainsFunc(acme, diff.TLSResolvers.Affects) {
+		diff.HTTPHandlers = changeAll(diff.HTTPHandlers, httpEntrypointRoutes(old), httpEntrypointRoutes(updated))
+	}
+
+	// HTTP handlers embed the client auth policies too, to check the Host
+	// of each request against the server name of its handshake
+	if !reflect.DeepEqual(old.TLS.ClientAuth, updated.TLS.ClientAuth) {
+		diff.TLSHandlers = changeAll(diff.TLSHandlers, entrypointResolvers(old), entrypointResolvers(updated))
+		diff.HTTPHandlers = changeAll(diff.HTTPHandlers, httpEntrypointRoutes(old), httpEntrypointRoutes(updated))
+	}
+
+	return diff
+}
+
+// Reconsile moves the engine from the current config to newConfig with
+// the smallest set of register and deregister calls. Everything is built
+// before anything is applied, so a config that fails to build leaves the
+// running state untouched.
+func (state *State) Reconsile(newConfig ServerConfig) error {
+	log.Printf("Applying config:\n%s", newConfig)
+
+	diff := DiffConfig(state.Config, newConfig)
+
+	// Health checkers are only started once their service is applied, so
+	// nothing needs stopping when the config fails to build
+	httpServices := make(map[string]http.Handler)
+	httpHealthCheckers := make(map[string][]*engine.HealthChecker)
+	for _, id := range diff.HTTPServices.Updated() {
+		var checkers []*engine.HealthChecker
+		service, err := buildHTTPService(newConfig.HTTP.Services[id], &checkers)
+		if err != nil {
+			return fmt.Errorf("http service \"%s\": %w", id, err)
+		}
+		httpServices[id] = service
+		httpHealthCheckers[id] = checkers
+	}
+
+	httpRoutes := make(map[string]*engine.HTTPRoute)
+	for _, id := range diff.HTTPRouters.Updated() {
+		route, err := buildHTTPRoute(newConfig.HTTP, newConfig.HTTP.Routes[id])
+		if err != nil {
+			return fmt.Errorf("http route \"%s\": %w", id, err)
+		}
+		httpRoutes[id] = route
+	}
+
+	globalMiddleware, err := buildMiddleware(newConfig.HTTP, newConfig.HTTP.Middlewares)
+	if err != nil {
+		return fmt.Errorf("http middlewares: %w", err)
+	}
+
+	tcpServices := make(map[string]engine.TCPServiceFunc)
+	tcpHealthCheckers := make(map[string][]*engine.HealthChecker)
+	for _, id := range diff.TCPServices.Updated() {
+		var checkers []*engine.HealthChecker
+		service, err := buildTCPService(newConfig.TCP.Services[id], &checkers)
+		if err != nil {
+			return fmt.Errorf("tcp service \"%s\": %w", id, err)
+		}
+		tcpServices[id] = service
+		tcpHealthCheckers[id] = checkers
+	}
+
+	tcpRoutes := make(map[string]*engine.TCPRoute)
+	for _, id := range diff.TCPRouters.Updated() {
+		route, err := buildTCPRoute(newConfig.TCP.Routes[id])
+		if err != nil {
+			return fmt.Errorf("tcp route \"%s\": %w", id, err)
+		}
+		tcpRoutes[id] = route
+	}
+
+	entrypoints := make(map[string]engine.TCPEntryPoint)
+	serverFirstTimeouts := make(map[string]time.Duration)
+	for _, id := range diff.Entrypoints.Updated() {
+		entrypoint, err := buildEntrypoint(id, newConfig.Entrypoints[id])
+		if err != nil {
+			return fmt.Errorf("entrypoint \"%s\": %w", id, err)
+		}
+		entrypoints[id] = entrypoint
+
+		serverFirstTimeouts[id], err = buildServerFirstTimeout(newConfig.Entrypoints[id])
+		if err != nil {
+			return fmt.Errorf("entrypoint \"%s\": %w", id, err)
+		}
+	}
+
+	tlsResolvers := maps.Clone(state.tlsResolvers)
+	for _, id := range diff.TLSResolvers.Removed {
+		delete(tlsResolvers, id)
+	}
+	updatedResolvers := diff.TLSResolvers.Updated()
+	for i, id := range updatedResolvers {
+		resolver, err := buildTLSResolver(newConfig.TLS.Resolvers[id])
+		if err != nil {
+			// Only the resolvers built so far are new, the rest still
+			// belong to the running state
+			closeTLSResolvers(tlsResolvers, updatedResolvers[:i])
+			return fmt.Errorf("tls resolver \"%s\": %w", id, err)
+		}
+		tlsResolvers[id] = resolver
+	}
+
+	resolversByEntrypoint := entrypointResolvers(newConfig)
+	for _, e := range diff.TLSHandlers.Updated() {
+		for _, id := range resolversByEntrypoint[e] {
+			if _, ok := tlsResolvers[id]; !ok {
+				closeTLSResolvers(tlsResolvers, diff.TLSResolvers.Updated())
+				return fmt.Errorf("entrypoint \"%s\" uses undefined tls resolver \"%s\"", e, id)
+			}
+		}
+	}
+
+	clientAuth, err := buildClientAuth(newConfig.TLS)
+	if err != nil {
+		closeTLSResolvers(tlsResolvers, diff.TLSResolvers.Updated())
+		return err
+	}
+
+	var challenges []engine.Middleware
+	for _, id := range acmeResolvers(newConfig) {
+		if resolver, ok := tlsResolvers[id].(*engine.ACMEResolver); ok {
+			challenges = append(challenges, resolver.HTTPChallenge())
+		}
+	}
+
+	// Everything is built, apply it
+
+	for id, service := range httpServices {
+		startHealthCheckers(httpHealthCheckers[id])
+		state.httpCompiler.RegisterService(id, service)
+	}
+
+	for _, id := range diff.HTTPRouters.Removed {
+		state.httpCompiler.DeregisterRouter(id, nil)
+	}
+	for id, route := range httpRoutes {
+		state.httpCompiler.RegisterRouter(id).
+			SetMiddleware(globalMiddleware).
+			RegisterRoute(id, route)
+	}
+
+	for id, service := range tcpServices {
+		startHealthCheckers(tcpHealthCheckers[id])
+		state.tcpCompiler.RegisterService(id, service)
+	}
+
+	for _, id := range diff.TCPRouters.Removed {
+		state.tcpCompiler.DeregisterRouter(id)
+	}
+	for id, route := range tcpRoutes {
+		state.tcpCompiler.RegisterRouter(id).RegisterRoute(id, route)
+	}
+
+	handlers := engine.Handlers{
+		HTTP:      maps.Clone(state.handlers.HTTP),
+		TCP:       maps.Clone(state.handlers.TCP),
+		TLSConfig: maps.Clone(state.handlers.TLSConfig),
+	}
+
+	httpRoutesByEntrypoint := httpEntrypointRoutes(newConfig)
+	for _, e := range diff.HTTPHandlers.Removed {
+		delete(handlers.HTTP, e)
+	}
+	for _, e := range diff.HTTPHandlers.Updated() {
+		handler := state.httpCompiler.Compile(httpRoutesByEntrypoint[e]...)
+		if len(clientAuth) > 0 {
+			handler = engine.ClientAuthHost(clientAuth).Wrap(handler)
+		}
+		for _, challenge := range challenges {
+			handler = challenge.Wrap(handler)
+		}
+		handlers.HTTP[e] = handler
+	}
+
+	tcpRoutesByEntrypoint := tcpEntrypointRoutes(newConfig)
+	for _, e := range diff.TCPHandlers.Removed {
+		delete(handlers.TCP, e)
+	}
+	for _, e := range diff.TCPHandlers.Updated() {
+		handlers.TCP[e] = state.tcpCompiler.Compile(tcpRoutesByEntrypoint[e]...)
+	}
+
+	for _, e := range diff.TLSHandlers.Removed {
+		delete(handlers.TLSConfig, e)
+	}
+	for _, e := range diff.TLSHandlers.Updated() {
+		var resolvers []engine.TLSConfigHandler
+		for _, id := range resolversByEntrypoint[e] {
+			resolvers = append(resolvers, tlsResolvers[id])
+		}
+		handler := sniTLSConfigHandler(resolvers)
+		if len(clientAuth) > 0 {
+			handler = engine.ClientAuth(handler, clientAuth)
+		}
+		handlers.TLSConfig[e] = handler
+	}
+
+	// Every entrypoint switches over at once, no connection is routed
+	// with handlers from two configs
+	state.Server.ReplaceHandlers(handlers)
+
+	// Services are only dropped once no compiled handler refers to them
+	for _, id := range diff.HTTPServices.Removed {
+		state.httpCompiler.DeregisterService(id)
+	}
+	for _, id := range diff.TCPServices.Removed {
+		state.tcpCompiler.DeregisterService(id)
+	}
+
+	for _, e := range diff.Entrypoints.Removed {
+		state.Server.DeregisterEntryPoint(e)
+	}
+	for _, e := range diff.Entrypoints.Changed {
+		state.Server.DeregisterEntryPoint(e)
+	}
+	for _, e := range diff.Entrypoints.Updated() {
+		state.Server.SetServerFirstTimeout(e, serverFirstTimeouts[e])
+		// Will need to change this to look if its a http/tcp, udp, or unix entrypoint
+		state.Server.RegisterEntryPoint(entrypoints[e])
+	}
+
+	// Replaced resolvers may still be renewing in the background
+	closeTLSResolvers(state.tlsResolvers, slices.Concat(diff.TLSResolvers.Changed, diff.TLSResolvers.Removed))
+
+	state.healthMu.Lock()
+	replaceHealthCheckers(state.httpHealthCheckers, httpHealthCheckers, diff.HTTPServices.Removed)
+	replaceHealthCheckers(state.tcpHealthCheckers, tcpHealthCheckers, diff.TCPServices.Removed)
+	state.healthMu.Unlock()
+
+	state.tlsResolvers = tlsResolvers
+	state.handlers = handlers
+	state.Config = newConfig
+
+	return nil
+}
+
+type ServiceHealth struct {
+	// http or tcp
+	Protocol string
+	Service  string
+	Members  []engine.HealthStatus
+}
+
+// HealthStatus returns the last check of every health checked load
+// balancer member, sorted by protocol and service.
+func (state *State) HealthStatus() []ServiceHealth {
+	state.healthMu.Lock()
+	defer state.healthMu.Unlock()
+
+	var services []ServiceHealth
+	for _, group := range []struct {
+		protocol string
+		checkers map[string][]*engine.HealthChecker
+	}{
+		{"http", state.httpHealthCheckers},
+		{"tcp", state.tcpHealthCheckers},
+	} {
+		for _, id := range slices.Sorted(maps.Keys(group.checkers)) {
+			health := ServiceHealth{Protocol: group.protocol, Service: id}
+			for _, checker := range group.checkers[id] {
+				health.Members = append(health.Members, checker.Status())
+			}
+			services = append(services, health)
+		}
+	}
+
+	return services
+}
+
+func startHealthCheckers(checkers []*engine.HealthChecker) {
+	for _, checker := range checkers {
+		checker.Start()
+	}
+}
+
+// replaceHealthCheckers closes the checkers of removed services and of
+// services that have been rebuilt with new ones.
+func replaceHealthCheckers(current map[string][]*engine.HealthChecker, updated map[string][]*engine.HealthChecker, removed []string) {
+	for _, id := range removed {
+		for _, checker := range current[id] {
+			checker.Close()
+		}
+		delete(current, id)
+	}
+
+	for id, checkers := range updated {
+		for _, checker := range current[id] {
+			checker.Close()
+		}
+		current[id] = checkers
+	}
+}
+
+func closeTLSResolvers(resolvers map[string]engine.TLSConfigHandler, ids []string) {
+	for _, id := range ids {
+		if closer, ok := resolvers[id].(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/aidanhopper/reverse-proxy/proxy-engine/engine"
+)
+
+// ValidateConfig resolves every reference in the config and reports all
+// problems at once rather than stopping at the first one.
+func ValidateConfig(config ServerConfig) error {
+	var errs []error
+
+	report := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	checkEntrypoints := func(kind, routeId string, entrypoints []string) {
+		for _, e := range entrypoints {
+			if _, ok := config.Entrypoints[e]; !ok {
+				report("%s route \"%s\": entrypoint \"%s\" is not defined", kind, routeId, e)
+			}
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(config.Entrypoints)) {
+		entrypoint := config.Entrypoints[id]
+
+		if entrypoint.Address == "" {
+			report("entrypoint \"%s\": address is not set", id)
+		}
+
+		if entrypoint.ProxyProtocol != nil && len(entrypoint.ProxyProtocol.Trusted) == 0 {
+			report("entrypoint \"%s\": proxy-protocol needs at least one trusted cidr", id)
+		}
+
+		if _, err := buildEntrypoint(id, entrypoint); err != nil {
+			report("entrypoint \"%s\": %s", id, err)
+		}
+
+		if _, err := buildServerFirstTimeout(entrypoint); err != nil {
+			report("entrypoint \"%s\": %s", id, err)
+		}
+	}
+
+	for _, name := range config.HTTP.Middlewares {
+		if _, err := resolveMiddleware(config.HTTP, name, nil); err != nil {
+			report("http middlewares: %s", err)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(config.HTTP.MiddlewareDefinitions)) {
+		if _, ok := builtinMiddlewares[name]; ok {
+			report("http middleware \"%s\": name is reserved for a builtin middleware", name)
+			continue
+		}
+		if _, err := resolveMiddleware(config.HTTP, name, nil); err != nil {
+			report("http middleware \"%s\": %s", name, err)
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(config.HTTP.Routes)) {
+		route := config.HTTP.Routes[id]
+
+		if _, err := engine.ParseHTTPRule(route.Rule); err != nil {
+			report("http route \"%s\": %s", id, err)
+		}
+
+		for _, name := range route.Middlewares {
+			if _, err := resolveMiddleware(config.HTTP, name, nil); err != nil {
+				report("http route \"%s\": %s", id, err)
+			}
+		}
+
+		if _, ok := config.HTTP.Services[route.Service]; !ok {
+			report("http route \"%s\": service \"%s\" is not defined", id, route.Service)
+		}
+
+		checkEntrypoints("http", id, route.Entrypoints)
+
+		if route.TLS != "" {
+			if _, ok := config.TLS.Resolvers[route.TLS]; !ok {
+				report("http route \"%s\": tls resolver \"%s\" is not defined", id, route.TLS)
+			}
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(config.HTTP.Services)) {
+		if _, err := buildHTTPService(config.HTTP.Services[id], nil); err != nil {
+			report("http service \"%s\": %s", id, err)
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(config.TCP.Routes)) {
+		route := config.TCP.Routes[id]
+
+		if _, err := engine.ParseTCPRule(route.Rule); err != nil {
+			report("tcp route \"%s\": %s", id, err)
+		}
+
+		if _, ok := config.TCP.Services[route.Service]; !ok {
+			report("tcp route \"%s\": service \"%s\" is not defined", id, route.Service)
+		}
+
+		checkEntrypoints("tcp", id, route.Entrypoints)
+
+		if route.TLS != "" {
+			if _, ok := config.TLS.Resolvers[route.TLS]; !ok {
+				report("tcp route \"%s\": tls resolver \"%s\" is not defined", id, route.TLS)
+			}
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(config.TCP.Services)) {
+		if _, err := buildTCPService(config.TCP.Services[id], nil); err != nil {
+			report("tcp service \"%s\": %s", id, err)
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(config.TLS.Resolvers)) {
+		resolver := config.TLS.Resolvers[id]
+
+		var kinds []string
+		if resolver.Certificate != "" || resolver.Key != "" {
+			kinds = append(kinds, "certificate")
+		}
+		if resolver.Directory != "" {
+			kinds = append(kinds, "directory")
+		}
+		if resolver.ACME != nil {
+			kinds = append(kinds, "acme")
+		}
+
+		if len(kinds) != 1 {
+			report(
+				"tls resolver \"%s\": exactly one of certificate, directory or acme must be set, found [%s]",
+				id,
+				strings.Join(kinds, ", "),
+			)
+		}
+
+		if (resolver.Certificate == "") != (resolver.Key == "") {
+			report("tls resolver \"%s\": certificate and key must both be set", id)
+		}
+
+		if resolver.Default != "" && resolver.Directory == "" {
+			report("tls resolver \"%s\": default needs a directory", id)
+		}
+
+		if resolver.ACME == nil {
+			continue
+		}
+
+		if len(resolver.ACME.Domains) == 0 {
+			report("tls resolver \"%s\": acme needs at least one domain", id)
+		}
+		if resolver.ACME.Storage == "" {
+			report("tls resolver \"%s\": acme needs a storage directory", id)
+		}
+		for _, challenge := range resolver.ACME.Challenges {
+			switch engine.ACMEChallenge(challenge) {
+			case engine.ACMEChallengeHTTP01, engine.ACMEChallengeTLSALPN01:
+			default:
+				report("tls resolver \"%s\": unknown acme challenge \"%s\"", id, challenge)
+			}
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(config.TLS.ClientAuth)) {
+		policy := config.TLS.ClientAuth[name]
+		switch engine.ClientAuthMode(policy.Mode) {
+		case engine.ClientAuthNone:
+		case engine.ClientAuthRequest, engine.ClientAuthRequire:
+			if policy.CA == "" {
+				report("tls client-auth \"%s\": %s needs a ca", name, policy.Mode)
+			}
+		default:
+			report("tls client-auth \"%s\": unknown mode \"%s\"", name, policy.Mode)
+		}
+	}
+
+	return errors.Join(errs...)
+}
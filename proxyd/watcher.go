@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const defaultReloadDebounce = 250 * time.Millisecond
+
+type ReloadStatus struct {
+	Time     time.Time
+	Checksum string
+	Err      error
+}
+
+// ConfigWatcher reloads the config when its file changes on disk. It
+// watches the directory of both the configured path and the file it
+// resolves to, so in-place writes, editor renames and symlink swaps such as
+// Kubernetes ConfigMap updates are all picked up. A config directory is
+// watched directly and any config file inside it triggers a reload. Bursts
+// of events are debounced and reloads whose contents did not change are
+// skipped.
+type ConfigWatcher struct {
+	path     string
+	isDir    bool
+	reload   func() (string, error)
+	debounce time.Duration
+	watcher  *fsnotify.Watcher
+	trigger  chan struct{}
+
+	realPath string
+	watched  map[string]bool
+	checksum string
+
+	mu         sync.Mutex
+	lastReload ReloadStatus
+}
+
+// NewConfigWatcher starts from the checksum of the config that is already
+// loaded. reload returns the checksum of the config it loaded, so that a
+// write landing between the check and the load is not mistaken for seen.
+func NewConfigWatcher(path string, checksum string, reload func() (string, error)) (*ConfigWatcher, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &ConfigWatcher{
+		path:     absPath,
+		isDir:    info.IsDir(),
+		reload:   reload,
+		debounce: defaultReloadDebounce,
+		watcher:  watcher,
+		trigger:  make(chan struct{}, 1),
+		watched:  make(map[string]bool),
+		checksum: checksum,
+	}
+
+	err = w.watchDirs()
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *ConfigWatcher) SetDebounce(d time.Duration) {
+	w.debounce = d
+}
+
+func (w *ConfigWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// Status returns the outcome of the most recent reload attempt, it is zero
+// until the first one.
+func (w *ConfigWatcher) Status() ReloadStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastReload
+}
+
+// Reload asks the watcher to reload even if the contents look unchanged.
+func (w *ConfigWatcher) Reload() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (w *ConfigWatcher) watchDirs() error {
+	dir := func(path string) string {
+		if w.isDir {
+			return path
+		}
+		return filepath.Dir(path)
+	}
+
+	dirs := []string{dir(w.path)}
+
+	realPath, err := filepath.EvalSymlinks(w.path)
+	if err == nil {
+		w.realPath = realPath
+		dirs = append(dirs, dir(realPath))
+	}
+
+	for _, dir := range dirs {
+		if w.watched[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			return err
+		}
+		w.watched[dir] = true
+	}
+
+	return nil
+}
+
+func (w *ConfigWatcher) relevant(event fsnotify.Event) bool {
+	if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+		return false
+	}
+
+	name := filepath.Clean(event.Name)
+	if name == w.path || name == w.realPath {
+		return true
+	}
+
+	if w.isDir && isConfigFile(name) {
+		dir := filepath.Dir(name)
+		return dir == w.path || dir == w.realPath
+	}
+
+	// Kubernetes swaps the ..data symlink to publish a new ConfigMap
+	if strings.HasPrefix(filepath.Base(name), "..") {
+		return true
+	}
+
+	realPath, err := filepath.EvalSymlinks(w.path)
+	return err == nil && realPath != w.realPath
+}
+
+func (w *ConfigWatcher) Run(ctx context.Context) {
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.relevant(event) {
+				timer.Reset(w.debounce)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Config watcher error:", err)
+		case <-timer.C:
+			w.reloadIfChanged(false)
+		case <-w.trigger:
+			w.reloadIfChanged(true)
+		}
+	}
+}
+
+func (w *ConfigWatcher) reloadIfChanged(force bool) {
+	// The file may now resolve somewhere else, keep following it
+	if err := w.watchDirs(); err != nil {
+		log.Println("Config watcher error:", err)
+	}
+
+	checksum, err := configChecksum(w.path)
+	if err != nil {
+		w.setStatus(ReloadStatus{Time: time.Now(), Err: err})
+		log.Printf("Config reload failed, keeping last good config: %s\n", err)
+		return
+	}
+
+	if !force && checksum == w.checksum {
+		return
+	}
+
+	loaded, err := w.reload()
+	if err != nil {
+		w.setStatus(ReloadStatus{Time: time.Now(), Checksum: checksum, Err: err})
+		log.Printf("Config reload failed, keeping last good config: %s\n", err)
+		return
+	}
+
+	w.setStatus(ReloadStatus{Time: time.Now(), Checksum: loaded})
+	w.checksum = loaded
+	log.Printf("Reloaded config %s (%s)\n", w.path, loaded[:12])
+}
+
+func (w *ConfigWatcher) setStatus(status ReloadStatus) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastReload = status
+}
+
+func configChecksum(path string) (string, error) {
+	files, err := configFiles(path)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		hashConfigFile(hash, file, data)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashConfigFile(hash io.Writer, file string, data []byte) {
+	fmt.Fprintf(hash, "%s %d\n", filepath.Base(file), len(data))
+	hash.Write(data)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestConfigWatcherStartsFromLoadedConfig changes the file after it was
+// loaded but before the watcher starts, the change must not be taken as
+// already loaded.
+func TestConfigWatcherStartsFromLoadedConfig(t *testing.T) {
+	path := writeConfig(t, "config.yml", `
+entrypoints:
+  web: ":80"
+`)
+
+	config, err := ReadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum, _ := configChecksum(path); config.checksum != checksum {
+		t.Fatalf("loaded checksum %s, file checksum %s", config.checksum, checksum)
+	}
+
+	err = os.WriteFile(path, []byte(`
+entrypoints:
+  web: ":8080"
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reloaded ServerConfig
+	w, err := NewConfigWatcher(path, config.checksum, func() (string, error) {
+		reloaded, err = ReadServerConfig(path)
+		return reloaded.checksum, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if status := w.Status(); !status.Time.IsZero() {
+		t.Fatalf("status %+v before any reload", status)
+	}
+
+	w.reloadIfChanged(false)
+
+	if got := reloaded.Entrypoints["web"].Address; got != ":8080" {
+		t.Fatalf("reloaded entrypoint %q, want :8080", got)
+	}
+
+	status := w.Status()
+	if status.Err != nil || status.Checksum != reloaded.checksum {
+		t.Errorf("status %+v, want the checksum of the reloaded config %s", status, reloaded.checksum)
+	}
+}